@@ -0,0 +1,255 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveSegmentExt    = ".log"
+	archiveIndexExt      = ".idx"
+	archiveBucketFmt     = "20060102T150405Z"
+	defaultArchiveBucket = time.Hour
+)
+
+// Archive writes JSON audit log records to segment files, one per time bucket, each with a sidecar index of the time,
+// user and offset of its records, so that the records of a time range, and optionally of a user, can be queried
+// without scanning every record. It is an io.Writer to be used as the Output of a Sink.
+type Archive struct {
+	dir    string
+	bucket time.Duration
+	now    func() time.Time
+
+	// mu serializes writes to the open segment and its index, and guards the in-memory indexes.
+	mu      sync.Mutex
+	start   time.Time
+	segment *os.File
+	index   *os.File
+	offset  int64
+	// buckets are the starts of the buckets with archived records, in time order.
+	buckets []time.Time
+	// indexes are the index entries of each bucket, in time order, and in write order for the same time.
+	indexes map[time.Time][]archiveIndexEntry
+}
+
+// archiveIndexEntry locates a record in its segment file.
+type archiveIndexEntry struct {
+	Time   int64  `json:"time"`
+	User   string `json:"user,omitempty"`
+	Offset int64  `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// NewArchive returns an archive writing its segments to dir, one per bucket of records. If bucket is 0, records are
+// bucketed by hour.
+func NewArchive(dir string, bucket time.Duration) (*Archive, error) {
+	if bucket <= 0 {
+		bucket = defaultArchiveBucket
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create audit archive directory: %w", err)
+	}
+	a := &Archive{dir: dir, bucket: bucket, now: time.Now, indexes: map[time.Time][]archiveIndexEntry{}}
+	if err := a.loadIndexes(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadIndexes reads the index of every segment already in the archive directory.
+func (a *Archive) loadIndexes() error {
+	names, err := filepath.Glob(filepath.Join(a.dir, "*"+archiveIndexExt))
+	if err != nil {
+		return fmt.Errorf("failed to list audit archive indexes: %w", err)
+	}
+	for _, name := range names {
+		start, err := time.Parse(archiveBucketFmt, strings.TrimSuffix(filepath.Base(name), archiveIndexExt))
+		if err != nil {
+			// Not a segment of the archive.
+			continue
+		}
+		if err := a.loadIndex(name, start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *Archive) loadIndex(name string, start time.Time) error {
+	index, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("failed to open audit archive index: %w", err)
+	}
+	defer index.Close()
+
+	scanner := bufio.NewScanner(index)
+	for scanner.Scan() {
+		var entry archiveIndexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("failed to decode audit archive index %s: %w", name, err)
+		}
+		a.addIndexEntry(start, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit archive index: %w", err)
+	}
+	return nil
+}
+
+// addIndexEntry adds an entry to the in-memory index of the bucket starting at start, keeping it in time order.
+func (a *Archive) addIndexEntry(start time.Time, entry archiveIndexEntry) {
+	entries, ok := a.indexes[start]
+	if !ok {
+		i := sort.Search(len(a.buckets), func(i int) bool { return !a.buckets[i].Before(start) })
+		a.buckets = append(a.buckets[:i], append([]time.Time{start}, a.buckets[i:]...)...)
+	}
+	// Records are mostly written in time order, so the entry is usually appended.
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Time > entry.Time })
+	a.indexes[start] = append(entries[:i], append([]archiveIndexEntry{entry}, entries[i:]...)...)
+}
+
+// Write archives a record in the segment of the bucket of its request timestamp, or of the current time if it has
+// none.
+func (a *Archive) Write(entry []byte) (int, error) {
+	var record struct {
+		RequestTimestamp string `json:"requestTimestamp"`
+		User             *User  `json:"user"`
+	}
+	// Records that are not JSON are still archived, at the time they are written and without a user.
+	_ = json.Unmarshal(entry, &record)
+	ts, err := time.Parse(time.RFC3339, record.RequestTimestamp)
+	if err != nil {
+		ts = a.now()
+	}
+	indexEntry := archiveIndexEntry{Time: ts.Unix(), Length: len(entry)}
+	if record.User != nil {
+		indexEntry.User = record.User.Name
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	start := ts.UTC().Truncate(a.bucket)
+	if err := a.openSegment(start); err != nil {
+		return 0, err
+	}
+	indexEntry.Offset = a.offset
+	n, err := a.segment.Write(entry)
+	a.offset += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write audit archive segment: %w", err)
+	}
+
+	line, err := json.Marshal(indexEntry)
+	if err != nil {
+		return n, fmt.Errorf("failed to encode audit archive index: %w", err)
+	}
+	if _, err := a.index.Write(append(line, '\n')); err != nil {
+		return n, fmt.Errorf("failed to write audit archive index: %w", err)
+	}
+	a.addIndexEntry(start, indexEntry)
+	return n, nil
+}
+
+// openSegment makes the segment of the bucket starting at start the open one, appending to it if it already exists.
+func (a *Archive) openSegment(start time.Time) error {
+	if a.segment != nil && a.start.Equal(start) {
+		return nil
+	}
+	if err := a.closeSegment(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(a.dir, start.Format(archiveBucketFmt))
+	segment, err := os.OpenFile(name+archiveSegmentExt, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit archive segment: %w", err)
+	}
+	info, err := segment.Stat()
+	if err != nil {
+		segment.Close()
+		return fmt.Errorf("failed to open audit archive segment: %w", err)
+	}
+	index, err := os.OpenFile(name+archiveIndexExt, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		segment.Close()
+		return fmt.Errorf("failed to open audit archive index: %w", err)
+	}
+
+	a.start, a.segment, a.index, a.offset = start, segment, index, info.Size()
+	return nil
+}
+
+func (a *Archive) closeSegment() error {
+	if a.segment == nil {
+		return nil
+	}
+	err := errors.Join(a.segment.Close(), a.index.Close())
+	a.segment, a.index = nil, nil
+	return err
+}
+
+// Close closes the open segment.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closeSegment()
+}
+
+// Query returns the archived records whose request timestamp is in [start, end), in time order and, for the same
+// time, in the order they were written. If user is not empty, only the records of that user are returned.
+func (a *Archive) Query(start, end time.Time, user string) ([][]byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var records [][]byte
+	first := sort.Search(len(a.buckets), func(i int) bool { return a.buckets[i].Add(a.bucket).After(start) })
+	for _, bucketStart := range a.buckets[first:] {
+		if !bucketStart.Before(end) {
+			break
+		}
+		entries := a.indexes[bucketStart]
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].Time >= start.Unix() })
+		j := sort.Search(len(entries), func(i int) bool { return entries[i].Time >= end.Unix() })
+		found, err := a.readRecords(bucketStart, entries[i:j], user)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, found...)
+	}
+	return records, nil
+}
+
+// readRecords reads the records of the segment of the bucket starting at start located by entries, skipping those of
+// other users than user if it is not empty.
+func (a *Archive) readRecords(start time.Time, entries []archiveIndexEntry, user string) ([][]byte, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	segment, err := os.Open(filepath.Join(a.dir, start.Format(archiveBucketFmt)+archiveSegmentExt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit archive segment: %w", err)
+	}
+	defer segment.Close()
+
+	var records [][]byte
+	for _, entry := range entries {
+		if user != "" && entry.User != user {
+			continue
+		}
+		record := make([]byte, entry.Length)
+		if _, err := segment.ReadAt(record, entry.Offset); err != nil {
+			return nil, fmt.Errorf("failed to read audit archive segment: %w", err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
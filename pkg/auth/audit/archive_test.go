@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func (a *AuditTest) TestArchive() {
+	dir := a.T().TempDir()
+	archive, err := NewArchive(dir, time.Hour)
+	a.Require().NoError(err)
+
+	handler, writer, _ := a.newTestAuditHandler(LevelMetadata, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	writer.Sinks = []Sink{{Output: archive, Level: LevelMetadata}}
+
+	base := time.Date(2024, 5, 1, 13, 50, 0, 0, time.UTC)
+	requests := []struct {
+		offset time.Duration
+		user   string
+		target string
+	}{
+		{offset: 0, user: "user-1", target: "/v3/clusters/1"},
+		{offset: 20 * time.Minute, user: "user-2", target: "/v3/clusters/2"},
+		{offset: 50 * time.Minute, user: "user-1", target: "/v3/clusters/3"},
+		{offset: 75 * time.Minute, user: "user-2", target: "/v3/clusters/4"},
+		{offset: 100 * time.Minute, user: "user-1", target: "/v3/clusters/5"},
+	}
+	for _, r := range requests {
+		now := base.Add(r.offset)
+		writer.Clock = func() time.Time { return now }
+		req := httptest.NewRequest(http.MethodGet, r.target, nil)
+		req = req.WithContext(request.WithUser(req.Context(), &user.DefaultInfo{Name: r.user}))
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	a.Require().NoError(archive.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+archiveSegmentExt))
+	a.Require().NoError(err)
+	a.Len(segments, 3, "Records should be written to one segment per hour")
+
+	targets := func(records [][]byte) []string {
+		var uris []string
+		for _, record := range records {
+			var log log
+			a.Require().NoError(json.Unmarshal(record, &log))
+			uris = append(uris, log.RequestURI)
+		}
+		return uris
+	}
+
+	// A new archive on the same directory reads the records written by the previous one.
+	archive, err = NewArchive(dir, time.Hour)
+	a.Require().NoError(err)
+
+	records, err := archive.Query(base.Add(10*time.Minute), base.Add(75*time.Minute), "")
+	a.Require().NoError(err)
+	a.Equal([]string{"/v3/clusters/2", "/v3/clusters/3"}, targets(records))
+
+	records, err = archive.Query(base.Add(10*time.Minute), base.Add(2*time.Hour), "user-1")
+	a.Require().NoError(err)
+	a.Equal([]string{"/v3/clusters/3", "/v3/clusters/5"}, targets(records))
+
+	records, err = archive.Query(base.Add(-time.Hour), base, "")
+	a.Require().NoError(err)
+	a.Empty(records)
+}
+
+func (a *AuditTest) TestArchiveOutOfOrder() {
+	archive, err := NewArchive(a.T().TempDir(), time.Hour)
+	a.Require().NoError(err)
+	defer archive.Close()
+
+	base := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	// Records are not always written in the order of their request timestamps, such as when requests overlap.
+	for _, offset := range []time.Duration{30 * time.Minute, 10 * time.Minute, 50 * time.Minute, 20 * time.Minute} {
+		record := fmt.Sprintf(`{"requestTimestamp":%q,"user":{"name":"user-1"}}`+"\n", base.Add(offset).Format(time.RFC3339))
+		_, err := archive.Write([]byte(record))
+		a.Require().NoError(err)
+	}
+
+	records, err := archive.Query(base.Add(15*time.Minute), base.Add(40*time.Minute), "user-1")
+	a.Require().NoError(err)
+	var timestamps []string
+	for _, record := range records {
+		var log log
+		a.Require().NoError(json.Unmarshal(record, &log))
+		timestamps = append(timestamps, log.RequestTimestamp)
+	}
+	a.Equal([]string{base.Add(20 * time.Minute).Format(time.RFC3339), base.Add(30 * time.Minute).Format(time.RFC3339)}, timestamps,
+		"Records should be returned in time order")
+}
+
+func (a *AuditTest) TestArchiveSplitRecords() {
+	archive, err := NewArchive(a.T().TempDir(), time.Hour)
+	a.Require().NoError(err)
+	defer archive.Close()
+
+	resBody := `{"value":"` + strings.Repeat("x", 4096) + `"}`
+	handler, writer, _ := a.newTestAuditHandler(LevelRequestResponse, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(resBody))
+	}))
+	writer.MaxRecordSize = 1024
+	writer.Sinks = []Sink{{Output: archive, Level: LevelRequestResponse}}
+	base := time.Date(2024, 5, 1, 13, 50, 0, 0, time.UTC)
+	writer.Clock = func() time.Time { return base }
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v3/clusters", nil))
+
+	records, err := archive.Query(base, base.Add(time.Minute), "user-1")
+	a.Require().NoError(err)
+	a.Require().Greater(len(records), 2, "The record should be split")
+	for i, record := range records {
+		var log log
+		a.Require().NoError(json.Unmarshal(record, &log))
+		a.Equal(i+1, log.Part, "Every part of the record should be found by the query")
+		a.Equal(len(records), log.TotalParts)
+	}
+}
@@ -6,28 +6,63 @@
 	"compress/gzip"
 	"compress/zlib"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/pborman/uuid"
 	v32 "github.com/rancher/rancher/pkg/apis/management.cattle.io/v3"
 	"github.com/sirupsen/logrus"
 	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/apiserver/pkg/endpoints/request"
-	"k8s.io/utils/strings/slices"
 )
 
 const (
-	contentTypeJSON     = "application/json"
-	contentEncodingGZIP = "gzip"
-	contentEncodingZLib = "deflate"
-	redacted            = "[redacted]"
+	contentTypeJSON      = "application/json"
+	contentTypeForm      = "application/x-www-form-urlencoded"
+	contentTypeJSONPatch = "application/json-patch+json"
+	contentEncodingGZIP  = "gzip"
+	contentEncodingZLib  = "deflate"
+	redacted             = "[redacted]"
+	// redactedDepthExceeded replaces values nested deeper than the writer's maximum redaction depth.
+	redactedDepthExceeded = "[redacted-depth-exceeded]"
+	// defaultMaxRedactDepth is the maximum redaction depth used when the writer does not set one.
+	defaultMaxRedactDepth = 64
+	// defaultBase64UploadMinSize is the size of base64 uploads from which they are redacted when the writer does not
+	// set one.
+	defaultBase64UploadMinSize = 64
+	// minBodyChunkSize is the size of the body chunks of split records when the writer's maximum record size leaves
+	// less room for them.
+	minBodyChunkSize = 256
+	// lastAppliedConfigAnnotation holds a JSON copy of the object as applied by kubectl, including the data of
+	// secrets, as a string.
+	lastAppliedConfigAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+	// contentTypeGRPCWeb prefixes the content types of gRPC-Web requests and responses, such as
+	// application/grpc-web+proto.
+	contentTypeGRPCWeb = "application/grpc-web"
+	contentTypeXML     = "application/xml"
+	contentTypeTextXML = "text/xml"
 )
 
 // Level represents a desired logging level.
@@ -46,19 +81,68 @@
 	generateKubeconfigURI = "action=generateKubeconfig"
 
 	auditLogErrKey = "auditLogError"
+
+	// schemaVersion identifies the structure of the audit log, it must be changed whenever the structure changes.
+	schemaVersion = "v1"
+
+	stageResponseStarted  = "ResponseStarted"
+	stageResponseComplete = "ResponseComplete"
+
+	bodyOmittedReasonSize         = "size"
+	bodyOmittedReasonBackpressure = "backpressure"
+	// bodyOmittedReasonEntrySize is set on the records replacing those larger than the writer's MaxEntryBytes.
+	bodyOmittedReasonEntrySize = "entrySize"
+	// bodyOmittedReasonEncoding is set when the response body has a Content-Encoding that cannot be decoded to redact it.
+	bodyOmittedReasonEncoding = "encoding"
+
+	// redactedResponseBody replaces the whole response body of the requests whose body must never be recorded.
+	redactedResponseBody = `{"_redacted":true}`
+
+	// UserHeader is the header used to pass the audited user of a request on to the requests it is proxied to.
+	UserHeader = "X-Rancher-Audit-User"
 )
 
 var (
+	// redactedBase64 is used instead of redacted where the value is expected to be valid base64.
+	redactedBase64 = base64.StdEncoding.EncodeToString([]byte(redacted))
+
 	bodyMethods = map[string]bool{
 		http.MethodPut:  true,
 		http.MethodPost: true,
+		// Patches are only captured when they are JSON, such as JSON patches.
+		http.MethodPatch: true,
+		// Delete options, such as the propagation policy or grace period, may be sent in the body of deletions.
+		http.MethodDelete: true,
 	}
+	// corsRequestHeaders are the headers of CORS preflight requests that are recorded even if they are not allowed.
+	corsRequestHeaders      = []string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"}
 	sensitiveRequestHeader  = []string{"Cookie", "Authorization", "X-Api-Tunnel-Params", "X-Api-Tunnel-Token", "X-Api-Auth-Header", "X-Amz-Security-Token"}
 	sensitiveResponseHeader = []string{"Cookie", "Set-Cookie", "X-Api-Set-Cookie-Header"}
-	sensitiveBodyFields     = []string{"credentials", "applicationSecret", "oauthCredential", "serviceAccountCredential", "spKey", "spCert", "certificate", "privateKey"}
-	// ErrUnsupportedEncoding is returned when the response encoding is unsupported
+	// defaultRedactQueryHeaders are response headers that may contain URLs with sensitive query parameters, such as
+	// a token in the redirect after login.
+	defaultRedactQueryHeaders = []string{"Location"}
+	sensitiveBodyFields       = []string{"credentials", "applicationSecret", "oauthCredential", "serviceAccountCredential", "spKey", "spCert", "certificate", "privateKey"}
+	// ErrUnsupportedEncoding is no longer returned, records of responses with an unsupported encoding are written
+	// without their response body instead.
+	//
+	// Deprecated: check the BodyOmittedReason of the records instead.
 	ErrUnsupportedEncoding = fmt.Errorf("unsupported encoding")
-	secretBaseType         = regexp.MustCompile(".\"baseType\":\"([A-Za-z]*[S|s]ecret)\".")
+	// ErrMarshal is returned when the log message cannot be encoded, this is not expected to succeed on retry.
+	ErrMarshal = fmt.Errorf("failed to marshal log message")
+	// ErrSinkWrite is returned when writing the log message to the output fails.
+	ErrSinkWrite = fmt.Errorf("failed to write log to output")
+	// ErrTransform is returned when the writer's transform fails on the encoded log message.
+	ErrTransform = fmt.Errorf("failed to transform log message")
+	// ErrTruncated is returned when only part of the log message was written to the output.
+	ErrTruncated = fmt.Errorf("log message truncated")
+	// errDecompressedTooLarge is returned when a compressed response decompresses to more than the writer's
+	// MaxBodySize.
+	errDecompressedTooLarge = fmt.Errorf("decompressed response too large")
+	// sampleFloat64 returns the random number used to sample requests, it can be replaced in tests.
+	sampleFloat64 = rand.Float64
+	// bearerToken matches values of an Authorization header using the Bearer scheme.
+	bearerToken    = regexp.MustCompile(`^\s*[bB]earer\s+\S`)
+	secretBaseType = regexp.MustCompile(".\"baseType\":\"([A-Za-z]*[S|s]ecret)\".")
 )
 
 type auditLog struct {
@@ -66,9 +150,35 @@ type auditLog struct {
 	writer            *LogWriter
 	reqBody           []byte
 	keysToRedactRegex *regexp.Regexp
+	// sampledOut is set when the request was not selected by sampling, the log is then only written if the
+	// response status must always be logged.
+	sampledOut bool
+	// redactedKeys collects the paths of the keys redacted from the body currently being redacted.
+	redactedKeys []string
+	// depth is the number of objects and arrays redactMap and redactSlice are currently nested in.
+	depth int
+	// reqBodyCapture, if set, captures the request body as the handler reads it, see LogWriter.MaxBodySize.
+	reqBodyCapture *cappedBuffer
+	// reqBodyCaptureForm is set when the captured request body is a form that is converted to JSON once captured.
+	reqBodyCaptureForm bool
+	// reqBodyJSONPatch is set when the request body is a JSON patch, whose operation values are redacted according to
+	// their path.
+	reqBodyJSONPatch bool
+	// reqBodyXML is set when the request body is XML, which is redacted by element and attribute names.
+	reqBodyXML bool
+	// requestedLevel is the level set with the writer's level header by a privileged user, or by the writer's policy,
+	// if levelRequested is set. LevelNull means the request is not audited.
+	requestedLevel Level
+	levelRequested bool
+	// dropped is set once an entry of the records of the request was lost, because it could not be written or was
+	// larger than the writer's MaxEntryBytes.
+	dropped bool
+	// unredacted is set when the bodies are recorded without redaction, see LogWriter.UnredactedGroups.
+	unredacted bool
 }
 
 type log struct {
+	SchemaVersion     string       `json:"auditSchemaVersion,omitempty"`
 	AuditID           k8stypes.UID `json:"auditID,omitempty"`
 	RequestURI        string       `json:"requestURI,omitempty"`
 	User              *User        `json:"user,omitempty"`
@@ -82,6 +192,151 @@ type log struct {
 	RequestBody       []byte       `json:"requestBody,omitempty"`
 	ResponseBody      []byte       `json:"responseBody,omitempty"`
 	UserLoginName     string       `json:"userLoginName,omitempty"`
+	Node              string       `json:"node,omitempty"`
+	// Stage is only set for upgraded connections and watches, which are audited once when started and again when
+	// they end.
+	Stage          string `json:"stage,omitempty"`
+	DurationMillis int64  `json:"durationMillis,omitempty"`
+	// RedactedKeys lists the paths of the keys whose values were redacted from the request and response bodies.
+	RedactedKeys []string `json:"redactedKeys,omitempty"`
+	// RequestBodySHA256 and ResponseBodySHA256 are the hex encoded SHA-256 digests of the bodies before redaction,
+	// recorded instead of the bodies if the writer is configured to hash them.
+	RequestBodySHA256  string `json:"requestBodySHA256,omitempty"`
+	ResponseBodySHA256 string `json:"responseBodySHA256,omitempty"`
+	// EventCount is the number of events sent in response to a watch request. It is only counted for JSON watches.
+	EventCount int `json:"eventCount,omitempty"`
+	// ResponseBodyRaw is the response body that is not JSON, recorded without redaction if the writer is configured
+	// to. It is base64 encoded in JSON records.
+	ResponseBodyRaw []byte `json:"responseBodyRaw,omitempty"`
+	// BodyOmittedReason is set when the bodies were left out of a log they should be recorded in.
+	BodyOmittedReason string `json:"bodyOmittedReason,omitempty"`
+	// RedactRules lists the names of the writer's redaction rules that matched a redacted key, if they are reported.
+	RedactRules []string `json:"redactRules,omitempty"`
+	// SuppressedCount is the number of identical requests that were not audited since this one last was, see
+	// LogWriter.DedupWindow.
+	SuppressedCount int `json:"suppressedCount,omitempty"`
+	// Mutating is set for requests with a method changing resources. It is always present, as false is meaningful.
+	Mutating bool `json:"mutating"`
+	// ClientClosed is set when the client closed the connection before the request was handled.
+	ClientClosed bool `json:"clientClosed,omitempty"`
+	// AuthFailed is set when the request was rejected as unauthenticated without any user, so that failed
+	// authentication attempts can be told apart from other anonymous requests.
+	AuthFailed bool `json:"authFailed,omitempty"`
+	// ForwardedFor lists the addresses of the X-Forwarded-For header of requests sent by a trusted proxy, if they are
+	// recorded.
+	ForwardedFor []string `json:"forwardedFor,omitempty"`
+	// Labels are the static labels of the writer, such as the environment, shared by all its logs.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Connection describes the TLS connection the request was received on, it is not set for plaintext requests.
+	Connection *Connection `json:"connection,omitempty"`
+	// Namespace, Resource and Name are parsed from the paths of requests to the Kubernetes API, such as
+	// /api/v1/namespaces/<namespace>/<resource>/<name>, so that records can be filtered by them.
+	Namespace string `json:"namespace,omitempty"`
+	Resource  string `json:"resource,omitempty"`
+	Name      string `json:"name,omitempty"`
+	// ClusterID is the ID of the downstream cluster the request is proxied to under /k8s/clusters/<cluster>, it is not
+	// set for requests to Rancher itself.
+	ClusterID string `json:"clusterID,omitempty"`
+	// RedactStats summarizes the redactions made to the bodies, if they are reported.
+	RedactStats *RedactStats `json:"redactStats,omitempty"`
+	// HeadersTruncated is set when request or response headers were left out because there were more than
+	// LogWriter.MaxHeaders of them.
+	HeadersTruncated bool `json:"headersTruncated,omitempty"`
+	// GRPCStatus is the status code of gRPC-Web calls, which respond with 200 whatever their outcome. It is set, even
+	// to 0 for calls that succeeded, when the response carries one.
+	GRPCStatus *int `json:"grpcStatus,omitempty"`
+	// QueryParams are the query parameters of the request, if they are recorded.
+	QueryParams map[string][]string `json:"queryParams,omitempty"`
+	// RejectReason is the reason a request was rejected before reaching an audited handler, see
+	// LogWriter.WriteMinimal.
+	RejectReason string `json:"rejectReason,omitempty"`
+	// Unredacted is set when the bodies were recorded without redaction because the user is in one of
+	// LogWriter.UnredactedGroups.
+	Unredacted bool `json:"unredacted,omitempty"`
+	// Summary is only set on the record written by LogWriter.WriteSummary, which is not about a request but summarizes
+	// those audited by the writer.
+	Summary *Summary `json:"summary,omitempty"`
+	// Part and TotalParts are set on the parts of a record split because it was larger than LogWriter.MaxRecordSize,
+	// starting from 1.
+	Part       int `json:"part,omitempty"`
+	TotalParts int `json:"totalParts,omitempty"`
+	// BodyChunk is set on the parts following the first one of a split record. Concatenated in the order of the
+	// parts, the chunks are a JSON object with the requestBody, responseBody and responseBodyRaw fields of the record.
+	// It is base64 encoded in JSON records.
+	BodyChunk []byte `json:"bodyChunk,omitempty"`
+}
+
+// recordBodies are the bodies of a record that is split into parts, see log.BodyChunk.
+type recordBodies struct {
+	RequestBody     json.RawMessage `json:"requestBody,omitempty"`
+	ResponseBody    json.RawMessage `json:"responseBody,omitempty"`
+	ResponseBodyRaw []byte          `json:"responseBodyRaw,omitempty"`
+}
+
+// Summary counts the requests audited by a writer, from its creation until the record holding the summary is written.
+type Summary struct {
+	// Audited is the number of requests whose record was written or attempted to be written. Upgraded connections and
+	// watches are counted once they end.
+	Audited int `json:"audited"`
+	// Dropped is the number of audited requests whose record, or part of it, was lost, because it could not be written
+	// to its output nor to the writer's Fallback, or because it was larger than LogWriter.MaxEntryBytes with
+	// LogWriter.DropOversizedEntries set.
+	Dropped int `json:"dropped"`
+	// FirstRequestTimestamp and LastRequestTimestamp are the earliest and latest timestamps of the audited requests.
+	FirstRequestTimestamp string `json:"firstRequestTimestamp,omitempty"`
+	LastRequestTimestamp  string `json:"lastRequestTimestamp,omitempty"`
+}
+
+// RedactStats counts the values redacted from the bodies of a request, to help tuning redaction without recording
+// the redacted values.
+type RedactStats struct {
+	Count int `json:"count"`
+	// Keys are the distinct names of the redacted keys, sorted.
+	Keys []string `json:"keys"`
+}
+
+// newRedactStats summarizes the redacted keys, or returns nil if there are none.
+func newRedactStats(redactedKeys []string) *RedactStats {
+	if len(redactedKeys) == 0 {
+		return nil
+	}
+	stats := &RedactStats{Count: len(redactedKeys)}
+	for _, path := range redactedKeys {
+		// The name of the key is the last element of its path, without any index, such as args in body.args[1].
+		key := path[strings.LastIndex(path, ".")+1:]
+		if i := strings.Index(key, "["); i > 0 {
+			key = key[:i]
+		}
+		if !slices.Contains(stats.Keys, key) {
+			stats.Keys = append(stats.Keys, key)
+		}
+	}
+	sort.Strings(stats.Keys)
+	return stats
+}
+
+// Connection holds information about the TLS connection of a request, such as the client certificate used by
+// automation authenticating with mutual TLS.
+type Connection struct {
+	TLSVersion  string `json:"tlsVersion,omitempty"`
+	CipherSuite string `json:"cipherSuite,omitempty"`
+	// ClientCertSubject is the distinguished name of the subject of the client certificate, if one was sent.
+	ClientCertSubject string `json:"clientCertSubject,omitempty"`
+}
+
+// newConnection returns the readable names of the parameters of the TLS connection, or nil if there is none.
+func newConnection(state *tls.ConnectionState) *Connection {
+	if state == nil {
+		return nil
+	}
+	conn := &Connection{
+		TLSVersion:  tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+	}
+	if len(state.PeerCertificates) != 0 {
+		conn.ClientCertSubject = state.PeerCertificates[0].Subject.String()
+	}
+	return conn
 }
 
 var userKey struct{}
@@ -91,21 +346,77 @@ type User struct {
 	Name  string              `json:"name,omitempty"`
 	Group []string            `json:"group,omitempty"`
 	Extra map[string][]string `json:"extra,omitempty"`
+	// UID is the unique ID of the user given by the authenticator.
+	UID string `json:"uid,omitempty"`
 	// RequestUser is the --as user
 	RequestUser string `json:"requestUser,omitempty"`
 	// RequestGroups is the --as-group list
 	RequestGroups []string `json:"requestGroups,omitempty"`
+	// AuthToken is the name of the Rancher token used to authenticate the request, never its secret.
+	AuthToken string `json:"authToken,omitempty"`
+}
+
+// isEmpty reports whether the user holds no information.
+func (u *User) isEmpty() bool {
+	return u.Name == "" && u.UID == "" && len(u.Group) == 0 && len(u.Extra) == 0 && u.RequestUser == "" && len(u.RequestGroups) == 0 && u.AuthToken == ""
 }
 
-func getUserInfo(req *http.Request) *User {
-	user, _ := request.UserFrom(req.Context())
+// getUserInfo returns the user who sent the request. If extraKeys is not nil, only the extra attributes with these keys
+// are recorded.
+func getUserInfo(req *http.Request, extraKeys []string) *User {
+	user, ok := request.UserFrom(req.Context())
+	if !ok {
+		// Authentication failed or was not attempted.
+		return &User{AuthToken: getTokenName(req)}
+	}
+
+	extra := user.GetExtra()
+	if extraKeys != nil {
+		extra = make(map[string][]string)
+		for _, key := range extraKeys {
+			if values, ok := user.GetExtra()[key]; ok {
+				extra[key] = values
+			}
+		}
+	}
 	return &User{
-		Name:  user.GetName(),
-		Group: user.GetGroups(),
-		Extra: user.GetExtra(),
+		Name:      user.GetName(),
+		UID:       user.GetUID(),
+		Group:     user.GetGroups(),
+		Extra:     extra,
+		AuthToken: getTokenName(req),
 	}
 }
 
+// getTokenName returns the name of the Rancher token used to authenticate the request, found the same way as
+// tokens.GetTokenAuthFromRequest. Rancher tokens are of the form <name>:<secret>, anything else is ignored so that a
+// secret is never returned.
+func getTokenName(req *http.Request) string {
+	var tokenAuthValue string
+	if authHeader := strings.TrimSpace(req.Header.Get("Authorization")); authHeader != "" {
+		scheme, value, _ := strings.Cut(authHeader, " ")
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(scheme, "Bearer"):
+			tokenAuthValue = value
+		case strings.EqualFold(scheme, "Basic"):
+			data, err := base64.URLEncoding.DecodeString(value)
+			if err != nil {
+				return ""
+			}
+			tokenAuthValue = string(data)
+		}
+	} else if cookie, err := req.Cookie("R_SESS"); err == nil {
+		tokenAuthValue = cookie.Value
+	}
+
+	name, _, found := strings.Cut(tokenAuthValue, ":")
+	if !found {
+		return ""
+	}
+	return name
+}
+
 func getUserNameForBasicLogin(body []byte) string {
 	input := &v32.BasicLogin{}
 	err := json.Unmarshal(body, input)
@@ -122,34 +433,116 @@ func FromContext(ctx context.Context) (*User, bool) {
 	return u, ok
 }
 
+// WithUser returns a copy of the context holding the user information.
+func WithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// SetUserHeader sets UserHeader to the encoded user information, so that it can be passed on to a proxied request.
+func SetUserHeader(header http.Header, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit user: %w", err)
+	}
+	header.Set(UserHeader, base64.StdEncoding.EncodeToString(data))
+	return nil
+}
+
+// WithUserFromHeader returns a copy of the context holding the user information decoded from UserHeader, or the
+// context itself if the header is not set. The header can be set by any client, so it must only be trusted on requests
+// proxied by Rancher.
+func WithUserFromHeader(ctx context.Context, header http.Header) (context.Context, error) {
+	value := header.Get(UserHeader)
+	if value == "" {
+		return ctx, nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return ctx, fmt.Errorf("failed to decode %s header: %w", UserHeader, err)
+	}
+	user := &User{}
+	if err := json.Unmarshal(data, user); err != nil {
+		return ctx, fmt.Errorf("failed to unmarshal %s header: %w", UserHeader, err)
+	}
+	return WithUser(ctx, user), nil
+}
+
 func newAuditLog(writer *LogWriter, req *http.Request, keysToRedactRegex *regexp.Regexp) (*auditLog, error) {
+	if regex := writer.redactRegex.Load(); regex != nil {
+		keysToRedactRegex = regex
+	}
+	remoteAddr, forwardedFor := writer.clientAddr(req)
 	auditLog := &auditLog{
 		writer: writer,
 		log: &log{
 			AuditID:          k8stypes.UID(uuid.NewRandom().String()),
 			RequestURI:       req.RequestURI,
 			Method:           req.Method,
-			RemoteAddr:       req.RemoteAddr,
-			RequestTimestamp: time.Now().Format(time.RFC3339),
+			RemoteAddr:       writer.remoteAddr(remoteAddr),
+			RequestTimestamp: writer.now().Format(time.RFC3339),
+			Node:             writer.Node,
+			Labels:           writer.Labels,
+			Connection:       newConnection(req.TLS),
 		},
 		keysToRedactRegex: keysToRedactRegex,
 	}
+	if writer.SchemaVersion {
+		auditLog.log.SchemaVersion = schemaVersion
+	}
+	if writer.RecordQueryParams {
+		auditLog.log.QueryParams = auditLog.queryParams(req.URL.Query())
+	}
+	auditLog.log.ClusterID, _ = cutClusterPath(req.URL.Path)
+	if res, ok := parseResourcePath(req.URL.Path); ok {
+		auditLog.log.Namespace, auditLog.log.Resource, auditLog.log.Name = res.namespace, res.resource, res.name
+	}
+	if writer.RecordForwardedFor {
+		for _, addr := range forwardedFor {
+			auditLog.log.ForwardedFor = append(auditLog.log.ForwardedFor, writer.remoteAddr(addr))
+		}
+	}
+	if req.Method == http.MethodGet && writer.ReadSampleRate > 0 && writer.ReadSampleRate < 1 {
+		auditLog.sampledOut = sampleFloat64() >= writer.ReadSampleRate
+	}
 
 	contentType := req.Header.Get("Content-Type")
 	loginReq := isLoginRequest(req.RequestURI)
-	if writer.Level >= LevelRequest || loginReq {
-		if bodyMethods[req.Method] && strings.HasPrefix(contentType, contentTypeJSON) {
+	auditLog.requestedLevel, auditLog.levelRequested = writer.requestLevel(req)
+	if writer.AuditPreflight && req.Method == http.MethodOptions {
+		// Preflight requests have no body, and only their headers are of interest.
+		auditLog.requestedLevel, auditLog.levelRequested = LevelMetadata, true
+	} else if !auditLog.levelRequested && writer.Policy != nil {
+		auditLog.requestedLevel, auditLog.levelRequested = writer.Policy.level(req), true
+	}
+	level := auditLog.captureLevel()
+	auditLog.reqBodyJSONPatch = strings.HasPrefix(contentType, contentTypeJSONPatch)
+	auditLog.reqBodyXML = isXMLContentType(contentType)
+	if level >= LevelRequest || loginReq {
+		isForm := writer.CaptureFormBodies && strings.HasPrefix(contentType, contentTypeForm)
+		isJSON := strings.HasPrefix(contentType, contentTypeJSON) || auditLog.reqBodyXML
+		if bodyMethods[req.Method] && (isJSON || isForm) && writer.MaxBodySize > 0 && !loginReq && level >= LevelRequest {
+			// Login bodies are small and needed before the handler is called, so they are always read beforehand.
+			auditLog.reqBodyCapture = captureBody(req, writer.MaxBodySize)
+			auditLog.reqBodyCaptureForm = isForm
+		} else if bodyMethods[req.Method] && (isJSON || isForm) {
 			reqBody, err := readBodyWithoutLosingContent(req)
 			if err != nil {
 				return nil, err
 			}
+			if isForm {
+				reqBody, err = auditLog.formBody(reqBody)
+				if err != nil {
+					return nil, err
+				}
+			}
 			if loginReq {
 				loginName := getUserNameForBasicLogin(reqBody)
 				if loginName != "" {
 					auditLog.log.UserLoginName = loginName
 				}
 			}
-			if writer.Level >= LevelRequest {
+			if level >= LevelRequest {
 				auditLog.reqBody = reqBody
 			}
 		}
@@ -158,11 +551,58 @@ func newAuditLog(writer *LogWriter, req *http.Request, keysToRedactRegex *regexp
 }
 
 func (a *auditLog) write(userInfo *User, reqHeaders, resHeaders http.Header, resCode int, resBody []byte) error {
+	if a.levelRequested && a.requestedLevel == LevelNull {
+		return nil
+	}
+	if a.reqBodyCapture != nil {
+		a.reqBody = a.capturedRequestBody()
+	}
+	if a.sampledOut && !a.writer.alwaysLog(resCode) {
+		return nil
+	}
+	if a.writer.ShouldLog != nil && !a.writer.ShouldLog(a.log.Method, resCode) {
+		return nil
+	}
+	// The logs of upgraded connections and watches come in pairs, so they are never suppressed.
+	if a.writer.DedupWindow > 0 && a.log.Stage == "" {
+		key := dedupKey{method: a.log.Method, uri: a.log.RequestURI, statusCode: resCode}
+		if userInfo != nil {
+			key.user = userInfo.Name
+		}
+		var suppress bool
+		suppress, a.log.SuppressedCount = a.writer.isDuplicate(key)
+		if suppress {
+			return nil
+		}
+	}
+
 	a.log.User = userInfo
-	a.log.ResponseTimestamp = time.Now().Format(time.RFC3339)
-	a.log.RequestHeader = filterOutHeaders(reqHeaders, sensitiveRequestHeader)
-	a.log.ResponseHeader = filterOutHeaders(resHeaders, sensitiveResponseHeader)
+	a.unredacted = a.writer.isUnredactedUser(userInfo)
+	a.log.ResponseTimestamp = a.writer.now().Format(time.RFC3339)
+	var reqTruncated, resTruncated bool
+	a.log.RequestHeader, reqTruncated = a.filterHeaders(reqHeaders, sensitiveRequestHeader)
+	if a.writer.AuditPreflight && a.log.Method == http.MethodOptions {
+		for _, key := range corsRequestHeaders {
+			if v, ok := reqHeaders[key]; ok {
+				a.log.RequestHeader[key] = v
+			}
+		}
+	}
+	a.log.ResponseHeader, resTruncated = a.filterHeaders(resHeaders, sensitiveResponseHeader)
+	a.log.ResponseHeader = a.redactHeaderQueries(a.log.ResponseHeader)
+	a.log.HeadersTruncated = reqTruncated || resTruncated
+	// A response code of 0 means it is unknown and is omitted from the log.
 	a.log.ResponseCode = resCode
+	a.log.Mutating = isMutation(a.log.Method)
+	a.log.AuthFailed = resCode == http.StatusUnauthorized && (userInfo == nil || userInfo.Name == "")
+	a.log.GRPCStatus = nil
+	if strings.HasPrefix(resHeaders.Get("Content-Type"), contentTypeGRPCWeb) {
+		// The bodies of gRPC-Web calls are framed protobuf messages that cannot be redacted, so the outcome of the call
+		// is recorded from its status instead.
+		if code, ok := grpcStatus(resHeaders, resBody); ok {
+			a.log.GRPCStatus = &code
+		}
+	}
 
 	if a.log.UserLoginName != "" {
 		if a.log.User.Extra == nil {
@@ -172,104 +612,1010 @@ func (a *auditLog) write(userInfo *User, reqHeaders, resHeaders http.Header, res
 		logrus.Debugf("Added username for login request to audit log %v", a.log.UserLoginName)
 	}
 
-	var buffer bytes.Buffer
+	if a.writer.DropEmptyFields && a.log.User != nil && a.log.User.isEmpty() {
+		a.log.User = nil
+	}
+
+	a.log.RedactedKeys = nil
+	a.log.RequestBodySHA256, a.log.ResponseBodySHA256 = "", ""
+	a.log.ResponseBodyRaw = nil
+	a.log.BodyOmittedReason = ""
+	a.log.RedactRules = nil
+	a.log.RedactStats = nil
+	a.log.Unredacted = false
+	var reqBody []byte
+	switch {
+	case a.writer.BodyOnMutationFailure && !isFailedMutation(a.log.Method, resCode):
+		resBody = nil
+	case a.bodiesTooLarge(resBody):
+		// The log is downgraded to metadata to bound its size, without spending time on redacting the bodies.
+		a.log.BodyOmittedReason = bodyOmittedReasonSize
+		resBody = nil
+	case a.writer.isBackedUp():
+		// Redacting and writing bodies would only make the backlog of slow outputs grow.
+		a.log.BodyOmittedReason = bodyOmittedReasonBackpressure
+		resBody = nil
+	default:
+		reqBody = a.requestBody()
+		var err error
+		resBody, err = a.responseBody(resHeaders, resBody)
+		if err != nil {
+			return err
+		}
+	}
 
-	alByte, err := json.Marshal(a.log)
+	if a.writer.ReportRedactStats {
+		a.log.RedactStats = newRedactStats(a.log.RedactedKeys)
+	}
+
+	return a.emit(resCode, reqBody, resBody)
+}
+
+// emit encodes the log message with the bodies and writes it to the writer's sinks, router or output.
+func (a *auditLog) emit(resCode int, reqBody, resBody []byte) error {
+	err := a.emitEntries(resCode, reqBody, resBody)
 	if err != nil {
-		return fmt.Errorf("failed to marshal log message: %w", err)
+		a.dropped = true
+	}
+	// Upgraded connections and watches are counted once, with their final record, as dropped if any of their records
+	// was.
+	if a.log.Summary == nil && a.log.Stage != stageResponseStarted {
+		a.writer.countAudited(a.log.RequestTimestamp, a.dropped)
 	}
+	return err
+}
 
-	buffer.Write(bytes.TrimSuffix(alByte, []byte("}")))
-	a.writeRequest(&buffer)
+// emitEntries writes the encoded entries of the log message to the writer's sinks, router or output.
+func (a *auditLog) emitEntries(resCode int, reqBody, resBody []byte) error {
+	if len(a.writer.Sinks) != 0 {
+		return a.writeSinks(reqBody, resBody)
+	}
 
-	if err = a.writeResponse(&buffer, resHeaders, resBody); err != nil {
+	entries, err := a.formatEntries(a.log, reqBody, resBody)
+	if err != nil {
 		return err
 	}
 
-	buffer.WriteString("}")
+	for _, entry := range entries {
+		if a.writer.Router != nil {
+			err = a.writer.Router.write(resCode, entry)
+			if err != nil {
+				a.writer.mu.Lock()
+				err = a.writer.writeFallback(entry, err)
+				a.writer.mu.Unlock()
+			}
+		} else {
+			err = a.writer.writeEntry(a.writer.Output, entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteSummary writes a record summarizing the requests audited by the writer, see Summary, such as when the server
+// shuts down, so that consumers can tell whether records are missing. It is written to Output, the default writer of
+// the Router, or every sink.
+func (l *LogWriter) WriteSummary() error {
+	if l == nil || (l.Output == nil && l.Router == nil && len(l.Sinks) == 0) {
+		return nil
+	}
+
+	a := &auditLog{
+		writer: l,
+		log: &log{
+			AuditID: k8stypes.UID(uuid.NewRandom().String()),
+			Node:    l.Node,
+			Labels:  l.Labels,
+			Summary: l.summary(),
+		},
+	}
+	if l.SchemaVersion {
+		a.log.SchemaVersion = schemaVersion
+	}
+	return a.emit(0, nil, nil)
+}
+
+// WriteMinimal writes a metadata record for a request rejected before reaching an audited handler, such as by rate
+// limiting or because its body is too large, with the status it was rejected with and the reason. The body is never
+// read, and the user is only recorded if it was already authenticated.
+func (l *LogWriter) WriteMinimal(req *http.Request, status int, reason string) error {
+	if l == nil || l.isIgnored(req) {
+		return nil
+	}
+
+	remoteAddr, _ := l.clientAddr(req)
+	now := l.now().Format(time.RFC3339)
+	a := &auditLog{
+		writer: l,
+		log: &log{
+			AuditID:           k8stypes.UID(uuid.NewRandom().String()),
+			RequestURI:        req.RequestURI,
+			Method:            req.Method,
+			RemoteAddr:        l.remoteAddr(remoteAddr),
+			RequestTimestamp:  now,
+			ResponseTimestamp: now,
+			ResponseCode:      status,
+			Node:              l.Node,
+			Labels:            l.Labels,
+			Mutating:          isMutation(req.Method),
+			RejectReason:      reason,
+		},
+	}
+	if l.SchemaVersion {
+		a.log.SchemaVersion = schemaVersion
+	}
+	if _, ok := request.UserFrom(req.Context()); ok {
+		a.log.User = getUserInfo(req, l.UserExtraKeys)
+	}
+	return a.emit(status, nil, nil)
+}
+
+// String returns the name of the level, such as "RequestResponse".
+func (l Level) String() string {
+	switch l {
+	case LevelNull:
+		return "Null"
+	case LevelMetadata:
+		return "Metadata"
+	case LevelRequest:
+		return "Request"
+	case LevelRequestResponse:
+		return "RequestResponse"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
 
-	var compactBuffer bytes.Buffer
-	err = json.Compact(&compactBuffer, buffer.Bytes())
+// isMutation reports whether requests with the given method change resources.
+func isMutation(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isFailedMutation reports whether a request with the given method changing resources failed with the status code.
+func isFailedMutation(method string, statusCode int) bool {
+	return isMutation(method) && statusCode >= http.StatusBadRequest
+}
+
+// captureLevel returns the level determining what is captured for the request, which is the level requested with the
+// writer's level header if any, or the writer's.
+func (a *auditLog) captureLevel() Level {
+	if a.levelRequested {
+		return a.requestedLevel
+	}
+	return a.writer.captureLevel()
+}
+
+// bodiesTooLarge reports whether the captured request and response bodies together are larger than the writer's
+// body size threshold.
+func (a *auditLog) bodiesTooLarge(resBody []byte) bool {
+	if a.writer.BodySizeThreshold <= 0 {
+		return false
+	}
+
+	var size int
+	level := a.captureLevel()
+	if level >= LevelRequest {
+		size += len(a.reqBody)
+	}
+	if level >= LevelRequestResponse {
+		size += len(resBody)
+	}
+	return size > a.writer.BodySizeThreshold
+}
+
+// format encodes the log message and the already redacted request and response bodies in the writer's format.
+// The encoded log message is then passed to the writer's transform, if any.
+func (a *auditLog) format(log *log, reqBody, resBody []byte) ([]byte, error) {
+	var entry []byte
+	var err error
+	if a.writer.Format == FormatProtobuf {
+		entry, err = formatProtobuf(log, reqBody, resBody)
+	} else {
+		entry, err = formatJSON(log, reqBody, resBody, a.writer.Pretty)
+	}
+	if err != nil || a.writer.Transform == nil {
+		return entry, err
+	}
+
+	entry, err = a.writer.Transform(entry)
 	if err != nil {
-		return fmt.Errorf("failed to compact audit log: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrTransform, err)
 	}
+	return entry, nil
+}
 
-	compactBuffer.WriteString("\n")
+// writeSinks writes the log message to each of the writer's sinks, leaving out the bodies above the level of the sink.
+func (a *auditLog) writeSinks(reqBody, resBody []byte) error {
+	var errs []error
+	for _, sink := range a.writer.Sinks {
+		log, sinkReqBody, sinkResBody := a.log, reqBody, resBody
+		if sink.Level < LevelRequestResponse {
+			log = log.withoutBody("responseBody")
+			sinkResBody = nil
+		}
+		if sink.Level < LevelRequest {
+			log = log.withoutBody("requestBody")
+			sinkReqBody = nil
+		}
 
-	_, err = a.writer.Output.Write(compactBuffer.Bytes())
+		entries, err := a.formatEntries(log, sinkReqBody, sinkResBody)
+		for _, entry := range entries {
+			if err = a.writer.writeEntry(sink.Output, entry); err != nil {
+				break
+			}
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// formatEntries encodes the record, split into parts if needed, and replaces or drops the entries larger than the
+// writer's MaxEntryBytes.
+func (a *auditLog) formatEntries(record *log, reqBody, resBody []byte) ([][]byte, error) {
+	entries, err := a.formatParts(record, reqBody, resBody)
+	if err != nil || a.writer.MaxEntryBytes <= 0 {
+		return entries, err
+	}
+
+	limited := entries[:0]
+	for _, entry := range entries {
+		if len(entry) <= a.writer.MaxEntryBytes {
+			limited = append(limited, entry)
+			continue
+		}
+		a.writer.oversizedEntries.Add(1)
+		if a.writer.DropOversizedEntries {
+			a.dropped = true
+			continue
+		}
+		replacement, err := a.format(record.minimal(), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(replacement) > a.writer.MaxEntryBytes {
+			// Even the minimal record is too large, such as with a very long user name.
+			a.dropped = true
+			continue
+		}
+		limited = append(limited, replacement)
+	}
+	return limited, nil
+}
+
+// minimal returns the log message reduced to the fields identifying the request and its outcome.
+func (l *log) minimal() *log {
+	minimal := &log{
+		SchemaVersion:     l.SchemaVersion,
+		AuditID:           l.AuditID,
+		Method:            l.Method,
+		RequestTimestamp:  l.RequestTimestamp,
+		ResponseTimestamp: l.ResponseTimestamp,
+		ResponseCode:      l.ResponseCode,
+		Node:              l.Node,
+		Mutating:          l.Mutating,
+		Part:              l.Part,
+		TotalParts:        l.TotalParts,
+		BodyOmittedReason: bodyOmittedReasonEntrySize,
+	}
+	if l.User != nil {
+		minimal.User = &User{Name: l.User.Name}
+	}
+	return minimal
+}
+
+// formatParts encodes the record, split into parts if it has bodies and is larger than the writer's MaxRecordSize.
+func (a *auditLog) formatParts(record *log, reqBody, resBody []byte) ([][]byte, error) {
+	entry, err := a.format(record, reqBody, resBody)
+	if err != nil {
+		return nil, err
+	}
+	maxSize := a.writer.MaxRecordSize
+	if maxSize <= 0 || len(entry) <= maxSize || (len(reqBody) == 0 && len(resBody) == 0 && len(record.ResponseBodyRaw) == 0) {
+		return [][]byte{entry}, nil
+	}
+
+	bodies, err := json.Marshal(recordBodies{RequestBody: jsonBody(reqBody), ResponseBody: jsonBody(resBody), ResponseBodyRaw: record.ResponseBodyRaw})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
+	}
+
+	// The chunks are sized for the largest part numbers and for their base64 encoding in JSON records.
+	overhead, err := a.format(record.continuation(math.MaxInt32, math.MaxInt32, nil), nil, nil)
 	if err != nil {
-		return fmt.Errorf("failed to write log to output: %w", err)
+		return nil, err
+	}
+	chunkSize := max((maxSize-len(overhead)-len(`,"bodyChunk":""`))*3/4, minBodyChunkSize)
+	totalParts := 1 + (len(bodies)+chunkSize-1)/chunkSize
+
+	first := *record
+	first.ResponseBodyRaw = nil
+	first.Part, first.TotalParts = 1, totalParts
+	entry, err = a.format(&first, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	entries := [][]byte{entry}
+	for part := 2; len(bodies) != 0; part++ {
+		chunk := bodies[:min(chunkSize, len(bodies))]
+		bodies = bodies[len(chunk):]
+		entry, err := a.format(record.continuation(part, totalParts, chunk), nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// continuation returns the log message of a part after the first of a split record, holding a chunk of its bodies.
+// Like every record, it carries the schema version so that consumers can decode it before reassembling the record,
+// and the request timestamp and user name so that it is found by the same queries as the first part, such as those of
+// an Archive.
+func (l *log) continuation(part, totalParts int, chunk []byte) *log {
+	continuation := &log{
+		SchemaVersion:    l.SchemaVersion,
+		AuditID:          l.AuditID,
+		RequestTimestamp: l.RequestTimestamp,
+		Mutating:         l.Mutating,
+		Part:             part,
+		TotalParts:       totalParts,
+		BodyChunk:        chunk,
+	}
+	if l.User != nil {
+		continuation.User = &User{Name: l.User.Name}
+	}
+	return continuation
+}
+
+// withoutBody returns a copy of the log message without the fields describing the body with the given name.
+func (l *log) withoutBody(name string) *log {
+	stripped := *l
+	stripped.RedactedKeys = nil
+	for _, key := range l.RedactedKeys {
+		// Keys of bodies that are arrays, such as JSON patches, start with an index.
+		if !strings.HasPrefix(key, name+".") && !strings.HasPrefix(key, name+"[") {
+			stripped.RedactedKeys = append(stripped.RedactedKeys, key)
+		}
+	}
+	if l.RedactStats != nil {
+		stripped.RedactStats = newRedactStats(stripped.RedactedKeys)
+	}
+	switch name {
+	case "requestBody":
+		stripped.RequestBodySHA256 = ""
+		// the request body is only left out when the response body is too.
+		stripped.RedactRules = nil
+	case "responseBody":
+		stripped.ResponseBodySHA256 = ""
+		stripped.ResponseBodyRaw = nil
+	}
+	return &stripped
+}
+
+// writeEntry writes the encoded log message to the output.
+func writeEntry(w io.Writer, entry []byte) error {
+	n, err := w.Write(entry)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSinkWrite, err)
+	}
+	if n < len(entry) {
+		return fmt.Errorf("%w: wrote %d of %d bytes", ErrTruncated, n, len(entry))
 	}
 
 	return nil
 }
 
-// writeRequest attempts to write the API request to the log message.
-func (a *auditLog) writeRequest(buf *bytes.Buffer) {
-	if a.writer.Level < LevelRequest || len(a.reqBody) == 0 {
-		return
+// jsonRecord is a log message with its bodies, which take precedence over the body fields of the log message.
+type jsonRecord struct {
+	*log
+	RequestBody  json.RawMessage `json:"requestBody,omitempty"`
+	ResponseBody json.RawMessage `json:"responseBody,omitempty"`
+}
+
+// formatJSON encodes the log message and the already redacted request and response bodies as a single line of JSON,
+// or as indented JSON followed by a newline if pretty is set.
+func formatJSON(log *log, reqBody, resBody []byte, pretty bool) ([]byte, error) {
+	record := jsonRecord{log: log, RequestBody: jsonBody(reqBody), ResponseBody: jsonBody(resBody)}
+	var entry []byte
+	var err error
+	if pretty {
+		entry, err = json.MarshalIndent(record, "", "  ")
+	} else {
+		entry, err = json.Marshal(record)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMarshal, err)
 	}
+	return append(entry, '\n'), nil
+}
 
-	buf.WriteString(`,"requestBody":`)
-	buf.Write(bytes.TrimSuffix(a.redactSensitiveData(a.log.RequestURI, a.reqBody), []byte("\n")))
+// redactResponseURI returns whether the response body of the request must be replaced as a whole.
+func (a *auditLog) redactResponseURI() bool {
+	for _, uri := range a.writer.RedactResponseURIs {
+		if uri.MatchString(a.log.RequestURI) {
+			return true
+		}
+	}
+	return false
 }
 
-// writeResponse attempt to write the API response to the log message.
-func (a *auditLog) writeResponse(buf *bytes.Buffer, resHeaders http.Header, resBody []byte) (err error) {
-	if a.writer.Level < LevelRequestResponse || resHeaders.Get("Content-Type") != contentTypeJSON || len(resBody) == 0 {
+// jsonBody returns the body to nest in a JSON record, as it is if it is valid JSON, or else as a string.
+func jsonBody(body []byte) json.RawMessage {
+	if len(body) == 0 || json.Valid(body) {
+		return body
+	}
+	// Strings are always encoded successfully, invalid UTF-8 being replaced.
+	s, _ := json.Marshal(string(body))
+	return s
+}
+
+// requestBody returns the redacted API request body if it should be written to the log message.
+func (a *auditLog) requestBody() []byte {
+	if a.captureLevel() < LevelRequest || len(a.reqBody) == 0 {
+		return nil
+	}
+	if a.writer.HashBodies {
+		a.log.RequestBodySHA256 = hashBody(a.reqBody)
 		return nil
 	}
 
+	var body []byte
+	switch {
+	case a.unredacted:
+		a.log.Unredacted = true
+		body = a.reqBody
+	case a.reqBodyJSONPatch:
+		body = a.redactJSONPatch(a.log.RequestURI, a.reqBody)
+	case a.reqBodyXML:
+		body = a.redactXML(a.reqBody)
+	default:
+		body = a.redactSensitiveData(a.log.RequestURI, a.reqBody)
+	}
+	a.recordRedactedKeys("requestBody")
+	return bytes.TrimSuffix(body, []byte("\n"))
+}
+
+// responseBody returns the decoded and redacted API response body if it should be written to the log message.
+func (a *auditLog) responseBody(resHeaders http.Header, resBody []byte) (_ []byte, err error) {
+	if a.captureLevel() < LevelRequestResponse || len(resBody) == 0 {
+		return nil, nil
+	}
+	// The digests of HashBodies are still recorded for the bodies replaced as a whole, as they do not reveal them.
+	if !a.writer.HashBodies && a.redactResponseURI() {
+		return []byte(redactedResponseBody), nil
+	}
+	contentType := resHeaders.Get("Content-Type")
+	isJSON := isJSONContentType(contentType)
+	isXML := isXMLContentType(contentType)
+	if !isJSON && !isXML && contentType != "" && !a.writer.RawResponseBodies {
+		return nil, nil
+	}
+
 	switch resHeaders.Get("Content-Encoding") {
 	case contentEncodingGZIP:
-		resBody, err = decompressGZIP(resBody)
+		resBody, err = decompressGZIP(resBody, a.writer.MaxBodySize)
 	case contentEncodingZLib:
-		resBody, err = decompressZLib(resBody)
+		resBody, err = decompressZLib(resBody, a.writer.MaxBodySize)
 	case "none":
 		// do nothing message is not encoded
 	case "":
 		// do nothing message is not encoded
 	default:
-		err = fmt.Errorf("%w '%s' in response header", ErrUnsupportedEncoding, resHeaders.Get("Content-Encoding"))
+		// The body cannot be redacted, so the record is still written without it.
+		a.log.BodyOmittedReason = bodyOmittedReasonEncoding
+		return nil, nil
 	}
 
+	if errors.Is(err, errDecompressedTooLarge) {
+		a.log.BodyOmittedReason = bodyOmittedReasonSize
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to decode response: %w", err)
+		// The compressed body cannot be redacted, so the error is recorded instead of it, and the log is still written.
+		return redactedBodyWithErr(fmt.Errorf("failed to decode response: %w", err)), nil
 	}
 
-	buf.WriteString(`,"responseBody":`)
-	buf.Write(bytes.TrimSuffix(a.redactSensitiveData(a.log.RequestURI, resBody), []byte("\n")))
+	if contentType == "" {
+		// Some handlers do not set the content type, so the body is sniffed to still record JSON responses.
+		isJSON = isJSONBody(resBody)
+		if !isJSON && !a.writer.RawResponseBodies {
+			return nil, nil
+		}
+	}
 
-	return nil
+	if a.writer.HashBodies {
+		a.log.ResponseBodySHA256 = hashBody(resBody)
+		return nil, nil
+	}
+	if !isJSON && !isXML {
+		// Bodies that are not JSON cannot be parsed to be redacted, so they are recorded as they are.
+		a.log.ResponseBodyRaw = resBody
+		return nil, nil
+	}
+
+	if a.unredacted {
+		a.log.Unredacted = true
+		return bytes.TrimSuffix(resBody, []byte("\n")), nil
+	}
+	var body []byte
+	if isXML {
+		body = a.redactXML(resBody)
+	} else {
+		body = a.redactSensitiveData(a.log.RequestURI, resBody)
+	}
+	a.recordRedactedKeys("responseBody")
+	return bytes.TrimSuffix(body, []byte("\n")), nil
+}
+
+// isJSONContentType reports whether the content type is JSON, whatever its parameters such as the charset, including
+// the media types with a +json suffix such as application/merge-patch+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == contentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// isXMLContentType reports whether the content type is XML, including the media types with an +xml suffix such as
+// application/atom+xml.
+func isXMLContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	return mediaType == contentTypeXML || mediaType == contentTypeTextXML || strings.HasSuffix(mediaType, "+xml")
+}
+
+// grpcStatus returns the status code of a gRPC-Web response, sent in the Grpc-Status header of responses without
+// messages, or else in the trailers frame ending the body.
+func grpcStatus(resHeaders http.Header, resBody []byte) (int, bool) {
+	if status := resHeaders.Get("Grpc-Status"); status != "" {
+		code, err := strconv.Atoi(status)
+		return code, err == nil
+	}
+
+	// Each frame is a flags byte, whose most significant bit is set for trailers, then the big endian length of its
+	// payload.
+	for len(resBody) >= 5 {
+		flags, length := resBody[0], binary.BigEndian.Uint32(resBody[1:5])
+		if uint64(len(resBody)-5) < uint64(length) {
+			break
+		}
+		payload := resBody[5 : 5+length]
+		resBody = resBody[5+length:]
+		if flags&0x80 == 0 {
+			continue
+		}
+		// Trailers are formatted as HTTP/1 headers.
+		for _, line := range strings.Split(string(payload), "\r\n") {
+			key, value, _ := strings.Cut(line, ":")
+			if strings.EqualFold(strings.TrimSpace(key), "grpc-status") {
+				code, err := strconv.Atoi(strings.TrimSpace(value))
+				return code, err == nil
+			}
+		}
+	}
+	return 0, false
+}
+
+// isJSONBody reports whether a body without a content type is JSON. It is first sniffed with http.DetectContentType,
+// which does not detect JSON, to avoid validating binary bodies.
+func isJSONBody(body []byte) bool {
+	if !strings.HasPrefix(http.DetectContentType(body), "text/plain") {
+		return false
+	}
+	return json.Valid(body)
+}
+
+// hashBody returns the hex encoded SHA-256 digest of body.
+func hashBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashRemoteAddr returns the hex encoded SHA-256 digest of the salted IP of the remote address, without its port, so
+// that requests from the same client can be correlated without recording its IP.
+func hashRemoteAddr(addr string, salt []byte) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(addr))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordRedactedKeys adds the keys redacted from the last redacted body to the log message, prefixed with the name of
+// the body they were redacted from.
+func (a *auditLog) recordRedactedKeys(prefix string) {
+	for _, key := range a.redactedKeys {
+		a.log.RedactedKeys = append(a.log.RedactedKeys, joinKeyPath(prefix, key))
+	}
+	a.redactedKeys = nil
+}
+
+// addRedactedKey records the path of a key whose value was redacted.
+func (a *auditLog) addRedactedKey(path string) {
+	a.redactedKeys = append(a.redactedKeys, path)
+}
+
+// joinKeyPath appends key, or an index such as [0], to the dot separated key path.
+func joinKeyPath(path, key string) string {
+	if path == "" || strings.HasPrefix(key, "[") {
+		return path + key
+	}
+	return path + "." + key
+}
+
+// capturedRequestBody returns the part of the request body captured so far, converted to JSON if it is a form.
+func (a *auditLog) capturedRequestBody() []byte {
+	body := a.reqBodyCapture.Bytes()
+	if !a.reqBodyCaptureForm || len(body) == 0 {
+		return body
+	}
+	// A truncated form is still a valid form, only missing its last fields, unless it was cut in an escape sequence.
+	body, err := a.formBody(body)
+	if err != nil {
+		return redactedBodyWithErr(err)
+	}
+	return body
+}
+
+// captureBody replaces the body of the request with one capturing up to max bytes of it as it is read.
+func captureBody(req *http.Request, max int) *cappedBuffer {
+	capture := &cappedBuffer{max: max}
+	req.Body = &teeReadCloser{Reader: io.TeeReader(req.Body, capture), Closer: req.Body}
+	return capture
+}
+
+// teeReadCloser reads from a tee of a body that is closed by Closer.
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// cappedBuffer is a buffer keeping at most max bytes written to it and discarding the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	if remaining := c.max - c.Len(); remaining > 0 {
+		c.Buffer.Write(p[:min(len(p), remaining)])
+	}
+	return len(p), nil
+}
+
+// formBody converts a URL-encoded form body to a JSON object, so that it is redacted and recorded like JSON bodies.
+// Fields with several values are recorded as arrays, except sensitive ones whose values are joined so that they are
+// redacted as a whole.
+func (a *auditLog) formBody(body []byte) ([]byte, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse form body: %w", err)
+	}
+
+	m := make(map[string]interface{}, len(form))
+	for key, values := range form {
+		if len(values) == 1 || a.isSensitiveKey(key) {
+			m[key] = strings.Join(values, ",")
+			continue
+		}
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		m[key] = list
+	}
+	return json.Marshal(m)
+}
+
+// resourcePath is the resource of the Kubernetes API a request path is for.
+type resourcePath struct {
+	apiGroup    string
+	namespace   string
+	resource    string
+	subresource string
+	name        string
+}
+
+// cutClusterPath returns the ID of the downstream cluster a request path is proxied to under /k8s/clusters/<cluster>,
+// and the path in that cluster. Both are empty for other paths.
+func cutClusterPath(path string) (clusterID, rest string) {
+	rest, ok := strings.CutPrefix(path, "/k8s/clusters/")
+	if !ok {
+		return "", ""
+	}
+	clusterID, rest, _ = strings.Cut(rest, "/")
+	return clusterID, "/" + rest
+}
+
+// parseResourcePath parses a path of the Kubernetes API, /api/<version>/... or /apis/<group>/<version>/..., including
+// those proxied to downstream clusters under /k8s/clusters/<cluster>. It reports whether the path is for a resource.
+func parseResourcePath(path string) (resourcePath, bool) {
+	var res resourcePath
+	if _, rest := cutClusterPath(path); rest != "" {
+		path = rest
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	switch {
+	case len(parts) > 2 && parts[0] == "api":
+		parts = parts[2:]
+	case len(parts) > 3 && parts[0] == "apis":
+		res.apiGroup = parts[1]
+		parts = parts[3:]
+	default:
+		return res, false
+	}
+
+	if parts[0] == "namespaces" && len(parts) > 1 {
+		res.namespace = parts[1]
+		// A namespace is in itself, as are its own subresources.
+		if len(parts) > 2 && parts[2] != "status" && parts[2] != "finalize" {
+			parts = parts[2:]
+		}
+	}
+	res.resource = parts[0]
+	if len(parts) > 1 {
+		res.name = parts[1]
+	}
+	if len(parts) > 2 {
+		res.subresource = parts[2]
+	}
+	return res, true
+}
+
+func isLoginRequest(uri string) bool {
+	return strings.Contains(uri, "?action=login")
+}
+
+func readBodyWithoutLosingContent(req *http.Request) ([]byte, error) {
+	if !bodyMethods[req.Method] {
+		return nil, nil
+	}
+
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
+
+	return bodyBytes, nil
+}
+
+// filterHeaders removes the sensitive headers and, if the writer has a list of allowed headers, any header not in it.
+// It reports whether headers were left out because of the writer's MaxHeaders.
+func (a *auditLog) filterHeaders(headers http.Header, sensitiveKeys []string) (map[string][]string, bool) {
+	if a.writer == nil {
+		return filterOutHeaders(headers, sensitiveKeys, 0)
+	}
+	if a.writer.MaskSensitiveHeaders {
+		headers, sensitiveKeys = maskHeaders(headers, sensitiveKeys), nil
+	}
+	if len(a.writer.AllowedHeaders) == 0 {
+		return filterOutHeaders(headers, sensitiveKeys, a.writer.MaxHeaders)
+	}
+
+	newHeader := make(map[string][]string)
+	for _, k := range a.writer.AllowedHeaders {
+		k = http.CanonicalHeaderKey(k)
+		if isExist(sensitiveKeys, k) {
+			continue
+		}
+		if v, ok := headers[k]; ok {
+			if a.writer.MaxHeaders > 0 && len(newHeader) == a.writer.MaxHeaders {
+				return newHeader, true
+			}
+			newHeader[k] = v
+		}
+	}
+	return newHeader, false
+}
+
+// filterOutHeaders removes the headers in filterKeys. If maxHeaders is not 0, only the first maxHeaders of the
+// remaining headers are kept, in the order of their names, and it reports whether any was left out.
+func filterOutHeaders(headers http.Header, filterKeys []string, maxHeaders int) (map[string][]string, bool) {
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		if isExist(filterKeys, k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	truncated := maxHeaders > 0 && len(keys) > maxHeaders
+	if truncated {
+		// Sort the names so that the same headers are kept for identical requests.
+		sort.Strings(keys)
+		keys = keys[:maxHeaders]
+	}
+
+	newHeader := make(map[string][]string, len(keys))
+	for _, k := range keys {
+		newHeader[k] = headers[k]
+	}
+	return newHeader, truncated
+}
+
+// maskHeaders returns a copy of the headers with the values of the sensitive ones redacted, keeping the scheme of
+// Authorization headers.
+func maskHeaders(headers http.Header, sensitiveKeys []string) http.Header {
+	masked := make(http.Header, len(headers))
+	for k, values := range headers {
+		if !isExist(sensitiveKeys, k) {
+			masked[k] = values
+			continue
+		}
+		maskedValues := make([]string, len(values))
+		for i, v := range values {
+			maskedValues[i] = redacted
+			if scheme, _, ok := strings.Cut(strings.TrimSpace(v), " "); ok && k == "Authorization" {
+				maskedValues[i] = scheme + " " + redacted
+			}
+		}
+		masked[k] = maskedValues
+	}
+	return masked
+}
+
+// redactHeaderQueries redacts sensitive query parameters in the values of the configured URL headers.
+func (a *auditLog) redactHeaderQueries(headers http.Header) http.Header {
+	queryHeaders := defaultRedactQueryHeaders
+	if a.writer != nil && a.writer.RedactQueryHeaders != nil {
+		queryHeaders = a.writer.RedactQueryHeaders
+	}
+
+	for _, name := range queryHeaders {
+		name = http.CanonicalHeaderKey(name)
+		values, ok := headers[name]
+		if !ok {
+			continue
+		}
+		// Copy the values so the headers of the actual response are left untouched.
+		redactedValues := make([]string, len(values))
+		for i, v := range values {
+			redactedValues[i] = a.redactQuery(v)
+		}
+		headers[name] = redactedValues
+	}
+	return headers
+}
+
+// queryParams returns the query parameters with the values of sensitive parameters redacted, or nil if there are
+// none.
+func (a *auditLog) queryParams(query url.Values) map[string][]string {
+	if len(query) == 0 {
+		return nil
+	}
+	params := make(map[string][]string, len(query))
+	for key, values := range query {
+		if a.isSensitiveKey(key) {
+			redactedValues := make([]string, len(values))
+			for i := range redactedValues {
+				redactedValues[i] = redacted
+			}
+			values = redactedValues
+		}
+		params[key] = values
+	}
+	return params
+}
+
+// redactQuery redacts the values of sensitive query parameters in the given URL, leaving the rest of it as is.
+func (a *auditLog) redactQuery(rawURL string) string {
+	path, rawQuery, found := strings.Cut(rawURL, "?")
+	if !found || rawQuery == "" {
+		return rawURL
+	}
+
+	fragment := ""
+	if i := strings.Index(rawQuery, "#"); i >= 0 {
+		rawQuery, fragment = rawQuery[:i], rawQuery[i:]
+	}
+
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		key, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if a.isSensitiveKey(key) {
+			params[i] = key + "=" + redacted
+		}
+	}
+
+	return path + "?" + strings.Join(params, "&") + fragment
+}
+
+// isSensitiveKey reports whether the value for the given key should be redacted.
+func (a *auditLog) isSensitiveKey(key string) bool {
+	if a.isRedactKey(key) {
+		return true
+	}
+	if a.isKeptKey(key) {
+		return false
+	}
+	if a.matchesSensitiveKey(key) {
+		return true
+	}
+	camel := camelCase(key)
+	return camel != key && (a.isRedactKey(camel) || a.matchesSensitiveKey(camel))
+}
+
+// isSensitiveField reports whether the value of a scalar field is sensitive, as decided by the writer's RedactFunc if
+// it is set, or else by its key.
+func (a *auditLog) isSensitiveField(key string, val interface{}) bool {
+	if a.writer == nil || a.writer.RedactFunc == nil {
+		return a.isSensitiveKey(key)
+	}
+	return val != redacted && a.writer.RedactFunc(key, val)
+}
+
+// matchesSensitiveKey reports whether key matches the redaction regex, one of the writer's redaction rules or is one of
+// the sensitive body fields.
+func (a *auditLog) matchesSensitiveKey(key string) bool {
+	if (a.keysToRedactRegex != nil && a.keysToRedactRegex.MatchString(key)) || slices.Contains(sensitiveBodyFields, key) {
+		return true
+	}
+	if a.writer == nil {
+		return false
+	}
+	for _, rule := range a.writer.RedactRules {
+		if rule.Pattern.MatchString(key) {
+			return true
+		}
+	}
+	return false
 }
 
-func isLoginRequest(uri string) bool {
-	return strings.Contains(uri, "?action=login")
+// addRedactRules records the names of the writer's redaction rules matching the redacted key, if they are reported.
+func (a *auditLog) addRedactRules(key string) {
+	if a.writer == nil || !a.writer.ReportRedactRules {
+		return
+	}
+	camel := camelCase(key)
+	for _, rule := range a.writer.RedactRules {
+		if (rule.Pattern.MatchString(key) || rule.Pattern.MatchString(camel)) && !slices.Contains(a.log.RedactRules, rule.Name) {
+			a.log.RedactRules = append(a.log.RedactRules, rule.Name)
+		}
+	}
 }
 
-func readBodyWithoutLosingContent(req *http.Request) ([]byte, error) {
-	if !bodyMethods[req.Method] {
-		return nil, nil
+// camelCase converts a snake_case or kebab-case key, such as the original proto field names used in gRPC-gateway
+// bodies, to the camelCase spelling the redaction rules are written for.
+func camelCase(key string) string {
+	if !strings.ContainsAny(key, "_-") {
+		return key
 	}
 
-	bodyBytes, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read request body: %w", err)
+	var b strings.Builder
+	upper := false
+	for _, r := range key {
+		if r == '_' || r == '-' {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
 	}
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
-
-	return bodyBytes, nil
+	return b.String()
 }
 
-func filterOutHeaders(headers http.Header, filterKeys []string) map[string][]string {
-	newHeader := make(map[string][]string)
-	for k, v := range headers {
-		if isExist(filterKeys, k) {
-			continue
-		}
-		newHeader[k] = v
+// isKeptKey reports whether key is in the writer's configured set of keys that are never redacted.
+func (a *auditLog) isKeptKey(key string) bool {
+	if a.writer == nil || len(a.writer.KeepKeys) == 0 {
+		return false
 	}
-	return newHeader
+	_, ok := a.writer.KeepKeys[key]
+	return ok
 }
 
 func isExist(array []string, key string) bool {
@@ -295,25 +1641,150 @@ func redactedBodyWithErr(auditErr error) []byte {
 	return body
 }
 
+// redactBody redacts the sensitive data of a body sent to or received from requestURI, according to the redaction
+// options of the writer and redactRegex, without needing an audit log.
+func redactBody(writer *LogWriter, redactRegex *regexp.Regexp, requestURI string, body []byte) []byte {
+	a := &auditLog{writer: writer, keysToRedactRegex: redactRegex}
+	return a.redactSensitiveData(requestURI, body)
+}
+
 func (a *auditLog) redactSensitiveData(requestURI string, body []byte) []byte {
+	// Unmarshalling and marshalling the body is expensive, skip it when the body cannot contain anything to redact.
+	if !a.mayContainSensitiveData(requestURI, body) && isJSONObject(body) {
+		return body
+	}
+
+	return a.redactJSON(requestURI, body)
+}
+
+// mayContainSensitiveData cheaply checks if any of the rules used by redactJSON could match the body by scanning
+// it for keys and command line flags, without unmarshalling it. It may report false positives but never false negatives.
+func (a *auditLog) mayContainSensitiveData(requestURI string, body []byte) bool {
+	if strings.Contains(requestURI, "secrets") || strings.Contains(requestURI, generateKubeconfigURI) {
+		return true
+	}
+	if bytes.Contains(body, []byte(`"baseType"`)) && secretBaseType.Match(body) {
+		return true
+	}
+	if bytes.Contains(body, []byte(lastAppliedConfigAnnotation)) {
+		// The keys of the embedded object are escaped in the annotation's value, so they can't be checked while
+		// scanning.
+		return true
+	}
+	if a.writer != nil {
+		for _, path := range a.writer.StripPaths {
+			if len(path) != 0 && bytes.Contains(body, []byte(`"`+path[len(path)-1]+`"`)) {
+				return true
+			}
+		}
+	}
+	if a.writer != nil && (len(a.writer.RedactValuePatterns) != 0 || a.writer.RedactFunc != nil) {
+		// Values may only match once unescaped, so they can't be checked while scanning.
+		return true
+	}
+
+	// Keys are usually repeated in collections, so only check each key once.
+	checked := make(map[string]bool)
+	for i := 0; i < len(body); i++ {
+		if body[i] != '"' {
+			continue
+		}
+
+		start := i + 1
+		end := start
+		escaped := false
+		for end < len(body) && body[end] != '"' {
+			if body[end] == '\\' {
+				escaped = true
+				end++
+			}
+			end++
+		}
+		if end >= len(body) {
+			// Unterminated string, let unmarshalling report the error.
+			return true
+		}
+		str := body[start:end]
+		i = end
+
+		next := end + 1
+		for next < len(body) && (body[next] == ' ' || body[next] == '\t' || body[next] == '\r' || body[next] == '\n') {
+			next++
+		}
+		if next < len(body) && body[next] == ':' {
+			if escaped {
+				// Keys with escaped characters may only match once unescaped.
+				return true
+			}
+			if string(str) == "key" && a.writer != nil && a.writer.RedactKeyValuePairs {
+				// Could be the name of a sensitive value, see redactKeyValuePair.
+				return true
+			}
+			sensitive, ok := checked[string(str)]
+			if !ok {
+				sensitive = a.isSensitiveKey(string(str)) || a.isBase64UploadKey(string(str))
+				checked[string(str)] = sensitive
+			}
+			if sensitive {
+				return true
+			}
+		} else if bytes.HasPrefix(str, []byte("--")) {
+			// Could be a sensitive command line flag, see redactSlice.
+			return true
+		} else if a.writer != nil && a.writer.RedactBearerTokens {
+			val := string(str)
+			if escaped {
+				// Values with escaped characters, such as "Bearer\tfakesecret", may only match once unescaped.
+				if err := json.Unmarshal(body[start-1:end+1], &val); err != nil {
+					return true
+				}
+			}
+			if a.isBearerToken(val) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isJSONObject reports whether body is a valid JSON object, which is much cheaper than unmarshalling it.
+func isJSONObject(body []byte) bool {
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) != 0 && trimmed[0] == '{' && json.Valid(body)
+}
+
+// redactJSON unmarshals the body and redacts any sensitive data found in it.
+func (a *auditLog) redactJSON(requestURI string, body []byte) []byte {
 	var m map[string]interface{}
 	if err := json.Unmarshal(body, &m); err != nil {
 		return redactedBodyWithErr(err)
 	}
 
 	var changed bool
+	if a.writer != nil {
+		for _, path := range a.writer.StripPaths {
+			if stripPath(m, path) {
+				changed = true
+			}
+		}
+	}
+
 	// Redact values of secret data.
 	if strings.Contains(requestURI, "secrets") || secretBaseType.Match(body) {
-		changed = a.redactSecretsData(requestURI, m)
+		changed = a.redactSecretsData(requestURI, m) || changed
 	}
 
 	if strings.Contains(requestURI, generateKubeconfigURI) {
 		// generateKubeconfig cannot rely on regex because it uses config key instead of [kK]ube[cC]onfig
-		changed = redact(m, "config")
+		if redact(m, "config") {
+			changed = true
+			a.addRedactedKey("config")
+		}
 	}
 
 	// Redact values for data considered sensitive: passwords, tokens, etc.
-	if !a.redactMap(m) && !changed {
+	if !a.redactMap(m, "") && !changed {
 		return body
 	}
 
@@ -325,6 +1796,176 @@ func (a *auditLog) redactSensitiveData(requestURI string, body []byte) []byte {
 	return newBody
 }
 
+// stripPath removes the key at path from the value, and from each item of the lists on the way to it, reporting
+// whether any was removed.
+func stripPath(val interface{}, path []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	switch val := val.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			if _, ok := val[path[0]]; !ok {
+				return false
+			}
+			delete(val, path[0])
+			return true
+		}
+		return stripPath(val[path[0]], path[1:])
+	case []interface{}:
+		var stripped bool
+		for _, item := range val {
+			if stripPath(item, path) {
+				stripped = true
+			}
+		}
+		return stripped
+	}
+	return false
+}
+
+// redactJSONPatch redacts the values of the operations of a JSON patch whose path is sensitive, since the key of the
+// value is only known from the path, as well as any sensitive data in the other values.
+func (a *auditLog) redactJSONPatch(requestURI string, body []byte) []byte {
+	var ops []interface{}
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return redactedBodyWithErr(err)
+	}
+
+	isSecret := strings.Contains(requestURI, "secrets")
+	var changed bool
+	for i, op := range ops {
+		m, ok := op.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		path, _ := m["path"].(string)
+		if _, ok := m["value"]; ok && a.isSensitivePatchPath(path, isSecret) {
+			m["value"] = redacted
+			a.addRedactedKey(fmt.Sprintf("[%d].value", i))
+			changed = true
+		}
+	}
+	if a.redactSlice(ops, "") {
+		changed = true
+	}
+	if !changed {
+		return body
+	}
+
+	newBody, err := json.Marshal(ops)
+	if err != nil {
+		return redactedBodyWithErr(err)
+	}
+	return newBody
+}
+
+// redactXML redacts the text of the XML elements and the values of the attributes whose names are sensitive, along with
+// the text of any element nested in a sensitive one. Names are matched without their namespace prefix. The body is
+// re-encoded only if anything was redacted, and replaced by the parse error if it is not valid XML, such as when it
+// was truncated.
+func (a *auditLog) redactXML(body []byte) []byte {
+	var buf bytes.Buffer
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	encoder := xml.NewEncoder(&buf)
+	// Elements are decoded and encoded with their raw names, since the encoder would otherwise declare their namespaces
+	// again on every element.
+	rawName := func(name xml.Name) xml.Name {
+		if name.Space == "" {
+			return name
+		}
+		return xml.Name{Local: name.Space + ":" + name.Local}
+	}
+
+	var path []string
+	// sensitiveDepth is the depth of the outermost sensitive element the decoder is in, or 0, and sensitivePath its
+	// path until its text is redacted.
+	var sensitiveDepth int
+	var sensitivePath string
+	var changed bool
+	for {
+		token, err := decoder.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return redactedBodyWithErr(fmt.Errorf("failed to parse XML body: %w", err))
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			elementPath := strings.Join(path, ".")
+			if sensitiveDepth == 0 && a.isSensitiveKey(t.Name.Local) {
+				sensitiveDepth, sensitivePath = len(path), elementPath
+			}
+			t.Name = rawName(t.Name)
+			attrs := make([]xml.Attr, len(t.Attr))
+			for i, attr := range t.Attr {
+				if attr.Name.Space != "xmlns" && attr.Name.Local != "xmlns" && a.isSensitiveKey(attr.Name.Local) {
+					attr.Value = redacted
+					changed = true
+					a.addRedactedKey(joinKeyPath(elementPath, "@"+attr.Name.Local))
+					a.addRedactRules(attr.Name.Local)
+				}
+				attr.Name = rawName(attr.Name)
+				attrs[i] = attr
+			}
+			t.Attr = attrs
+			token = t
+		case xml.EndElement:
+			if len(path) == sensitiveDepth {
+				sensitiveDepth = 0
+			}
+			if len(path) != 0 {
+				path = path[:len(path)-1]
+			}
+			t.Name = rawName(t.Name)
+			token = t
+		case xml.CharData:
+			if sensitiveDepth != 0 && len(bytes.TrimSpace(t)) != 0 {
+				token = xml.CharData(redacted)
+				changed = true
+				if sensitivePath != "" {
+					a.addRedactedKey(sensitivePath)
+					a.addRedactRules(path[sensitiveDepth-1])
+					sensitivePath = ""
+				}
+			}
+		}
+		if err := encoder.EncodeToken(token); err != nil {
+			return redactedBodyWithErr(fmt.Errorf("failed to parse XML body: %w", err))
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return redactedBodyWithErr(fmt.Errorf("failed to parse XML body: %w", err))
+	}
+	if len(path) != 0 {
+		return redactedBodyWithErr(errors.New("failed to parse XML body: unexpected EOF"))
+	}
+	if !changed {
+		return body
+	}
+	return buf.Bytes()
+}
+
+// isSensitivePatchPath reports whether the JSON pointer of a patch operation points to or into a sensitive key, or
+// into the data of a secret.
+func (a *auditLog) isSensitivePatchPath(path string, isSecret bool) bool {
+	keys := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if isSecret && (keys[0] == "data" || keys[0] == "stringData") {
+		return true
+	}
+	for _, key := range keys {
+		// ~1 and ~0 are the escapes of / and ~ in JSON pointers.
+		key = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+		if a.isSensitiveKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
 func redact(body map[string]interface{}, key string) bool {
 	if _, ok := body[key]; !ok {
 		return false
@@ -339,7 +1980,7 @@ func (a *auditLog) redactSecretsData(requestURI string, body map[string]interfac
 	isK8sProxyList := strings.HasPrefix(requestURI, "/k8s/") && (body["kind"] != nil && body["kind"] == "SecretList")
 	isRegularList := body["type"] != nil && body["type"] == "collection"
 	if !(isK8sProxyList || isRegularList) {
-		return redactSecret(body)
+		return a.redactSecret(body, "")
 	}
 
 	itemsKey := "data"
@@ -355,6 +1996,7 @@ func (a *auditLog) redactSecretsData(requestURI string, body map[string]interfac
 	secretsList, ok := body[itemsKey].([]interface{})
 	if !ok {
 		body[itemsKey] = redacted
+		a.addRedactedKey(itemsKey)
 		logrus.Debugf("auditLog: Redacting entire value for key [%s] in response to request URI [%s], unable to assert body is of type []interface{}", itemsKey, requestURI)
 		return true
 	}
@@ -363,11 +2005,12 @@ func (a *auditLog) redactSecretsData(requestURI string, body map[string]interfac
 		m, ok := secret.(map[string]interface{})
 		if !ok {
 			secretsList[index] = redacted
+			a.addRedactedKey(fmt.Sprintf("%s[%d]", itemsKey, index))
 			logrus.Debugf("auditLog: Redacting entire value for index [%d] in list in response to request URI [%s]. Failed to assert secret element as map[string]interface", index, requestURI)
 			continue
 		}
 
-		changed = redactSecret(m) || changed
+		changed = a.redactSecret(m, fmt.Sprintf("%s[%d]", itemsKey, index)) || changed
 		secretsList[index] = m
 	}
 
@@ -379,14 +2022,16 @@ func (a *auditLog) redactSecretsData(requestURI string, body map[string]interfac
 	return changed
 }
 
-func redactSecret(secret map[string]interface{}) bool {
+func (a *auditLog) redactSecret(secret map[string]interface{}, path string) bool {
 	var changed bool
 	if secret["data"] != nil {
-		secret["data"] = redacted
+		secret["data"] = a.redactedSecretData(secret["data"])
+		a.addRedactedKey(joinKeyPath(path, "data"))
 		changed = true
 	}
 	if secret["stringData"] != nil {
 		secret["stringData"] = redacted
+		a.addRedactedKey(joinKeyPath(path, "stringData"))
 		changed = true
 	}
 	if changed {
@@ -401,27 +2046,84 @@ func redactSecret(secret map[string]interface{}) bool {
 			continue
 		}
 		secret[key] = redacted
+		a.addRedactedKey(joinKeyPath(path, key))
 		changed = true
 	}
 	return changed
 }
 
-func (a *auditLog) redactMap(m map[string]interface{}) bool {
+// redactedSecretData returns the value used to replace the data of a secret. If the writer is configured to keep
+// secret data as valid base64, each value of the data is replaced by redactedBase64 instead of replacing the whole data.
+func (a *auditLog) redactedSecretData(data interface{}) interface{} {
+	if a.writer == nil || !a.writer.RedactSecretDataBase64 {
+		return redacted
+	}
+
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return redactedBase64
+	}
+	for key := range m {
+		m[key] = redactedBase64
+	}
+	return m
+}
+
+func (a *auditLog) redactMap(m map[string]interface{}, path string) bool {
+	a.depth++
+	defer func() { a.depth-- }()
+
 	var changed bool
+	if a.redactKeyValuePair(m) {
+		changed = true
+		a.addRedactedKey(joinKeyPath(path, "value"))
+		a.addRedactRules(m["key"].(string))
+	}
 	for key := range m {
+		if key == lastAppliedConfigAnnotation {
+			if a.redactLastAppliedConfig(m, joinKeyPath(path, key)) {
+				changed = true
+			}
+			continue
+		}
 		switch val := m[key].(type) {
-		case string:
-			if a.keysToRedactRegex.MatchString(key) || slices.Contains(sensitiveBodyFields, key) {
+		case string, float64, json.Number, bool:
+			if !a.isRedactableScalar(val) {
+				continue
+			}
+			if a.isSensitiveField(key, val) || a.isSensitiveValue(val) || a.isBase64Upload(key, val) {
 				changed = true
 				m[key] = redacted
+				a.addRedactedKey(joinKeyPath(path, key))
+				a.addRedactRules(key)
 			}
 		case map[string]interface{}:
-			if a.redactMap(val) {
+			if a.isSensitiveKey(key) {
+				if wrapped, ok := a.redactWrapper(val); ok {
+					changed = true
+					a.addRedactedKey(joinKeyPath(joinKeyPath(path, key), wrapped))
+					a.addRedactRules(key)
+					continue
+				}
+			}
+			if a.depthExceeded() {
+				changed = true
+				m[key] = redactedDepthExceeded
+				a.addRedactedKey(joinKeyPath(path, key))
+				continue
+			}
+			if a.redactMap(val, joinKeyPath(path, key)) {
 				changed = true
 				m[key] = val
 			}
 		case []interface{}:
-			if a.redactSlice(val) {
+			if a.depthExceeded() {
+				changed = true
+				m[key] = redactedDepthExceeded
+				a.addRedactedKey(joinKeyPath(path, key))
+				continue
+			}
+			if a.redactSlice(val, joinKeyPath(path, key)) {
 				changed = true
 				m[key] = val
 			}
@@ -431,52 +2133,249 @@ func (a *auditLog) redactMap(m map[string]interface{}) bool {
 	return changed
 }
 
-func (a *auditLog) redactSlice(valSlice []interface{}) bool {
+// redactLastAppliedConfig redacts the object embedded as JSON in the last-applied-configuration annotation of m like
+// any other body, including the data of secrets, then embeds it again. An annotation that is not a JSON object is
+// redacted as a whole, as it cannot be told whether it holds sensitive data.
+func (a *auditLog) redactLastAppliedConfig(m map[string]interface{}, path string) bool {
+	val, ok := m[lastAppliedConfigAnnotation].(string)
+	if !ok || val == "" {
+		return false
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(val), &obj); err != nil {
+		m[lastAppliedConfigAnnotation] = redacted
+		a.addRedactedKey(path)
+		return true
+	}
+	var changed bool
+	if obj["kind"] == "Secret" {
+		changed = a.redactSecret(obj, path)
+	}
+	if !a.redactMap(obj, path) && !changed {
+		return false
+	}
+
+	newVal, err := json.Marshal(obj)
+	if err != nil {
+		m[lastAppliedConfigAnnotation] = redacted
+		a.addRedactedKey(path)
+		return true
+	}
+	m[lastAppliedConfigAnnotation] = string(newVal)
+	return true
+}
+
+// depthExceeded reports whether redaction is nested as deep as the writer allows, in which case the values that would
+// be recursed into are replaced as a whole to bound the time spent on maliciously nested bodies.
+func (a *auditLog) depthExceeded() bool {
+	maxDepth := defaultMaxRedactDepth
+	if a.writer != nil && a.writer.MaxRedactDepth > 0 {
+		maxDepth = a.writer.MaxRedactDepth
+	}
+	return a.depth >= maxDepth
+}
+
+// isSensitiveValue reports whether val is sensitive whatever its key, because it is a bearer token or matches one of
+// the writer's value patterns.
+func (a *auditLog) isSensitiveValue(val interface{}) bool {
+	if a.isBearerToken(val) {
+		return true
+	}
+	if a.writer == nil || len(a.writer.RedactValuePatterns) == 0 {
+		return false
+	}
+	s, ok := val.(string)
+	if !ok {
+		return false
+	}
+	for _, pattern := range a.writer.RedactValuePatterns {
+		if pattern.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBase64UploadKey reports whether key is one of the writer's base64 upload keys.
+func (a *auditLog) isBase64UploadKey(key string) bool {
+	if a.writer == nil {
+		return false
+	}
+	for _, uploadKey := range a.writer.Base64UploadKeys {
+		if strings.EqualFold(key, uploadKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBase64Upload reports whether val is a file uploaded as a base64 string under one of the writer's base64 upload
+// keys, possibly as a data URL, and is large enough to be redacted.
+func (a *auditLog) isBase64Upload(key string, val interface{}) bool {
+	s, ok := val.(string)
+	if !ok || !a.isBase64UploadKey(key) {
+		return false
+	}
+	minSize := defaultBase64UploadMinSize
+	if a.writer.Base64UploadMinSize > 0 {
+		minSize = a.writer.Base64UploadMinSize
+	}
+	if len(s) < minSize {
+		return false
+	}
+
+	if rest, ok := strings.CutPrefix(s, "data:"); ok {
+		_, s, ok = strings.Cut(rest, ";base64,")
+		if !ok {
+			return false
+		}
+	}
+	// Encoded files are often wrapped over multiple lines.
+	s = strings.NewReplacer("\r", "", "\n", "").Replace(s)
+	if _, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return true
+	}
+	_, err := base64.RawStdEncoding.DecodeString(s)
+	return err == nil
+}
+
+// isBearerToken reports whether val is a string holding a bearer token, such as an Authorization header echoed in a
+// body, if the writer is configured to redact them regardless of their key.
+func (a *auditLog) isBearerToken(val interface{}) bool {
+	if a.writer == nil || !a.writer.RedactBearerTokens {
+		return false
+	}
+	s, ok := val.(string)
+	return ok && bearerToken.MatchString(s)
+}
+
+// isRedactableScalar reports whether val is a scalar that is redacted if sensitive: a string, or a number or boolean if
+// the writer is configured to redact them or has a RedactFunc to decide.
+func (a *auditLog) isRedactableScalar(val interface{}) bool {
+	switch val.(type) {
+	case string:
+		return true
+	case float64, json.Number, bool:
+		// Numbers and booleans can be sensitive too, such as a numeric PIN.
+		return a.writer != nil && (a.writer.RedactNonStringValues || a.writer.RedactFunc != nil)
+	}
+	return false
+}
+
+// redactWrapper redacts the value of an object wrapping a single value, such as a oneof or a wrapper type in a
+// gRPC-gateway body, whose own key is sensitive. It returns the key of the redacted value.
+func (a *auditLog) redactWrapper(m map[string]interface{}) (string, bool) {
+	if len(m) != 1 {
+		return "", false
+	}
+	for key, val := range m {
+		if a.isRedactableScalar(val) {
+			m[key] = redacted
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// redactKeyValuePair redacts the value of an object of the form {"key": "<name>", "value": "<value>"} if the writer is
+// configured to and the name is sensitive, as the key of the value itself is not.
+func (a *auditLog) redactKeyValuePair(m map[string]interface{}) bool {
+	if a.writer == nil || !a.writer.RedactKeyValuePairs {
+		return false
+	}
+	name, ok := m["key"].(string)
+	if !ok || m["value"] == nil || !a.isSensitiveKey(name) {
+		return false
+	}
+	m["value"] = redacted
+	return true
+}
+
+// isRedactKey reports whether key is in the writer's configured set of keys to redact.
+func (a *auditLog) isRedactKey(key string) bool {
+	if a.writer == nil {
+		return false
+	}
+	keys := a.writer.getRedactKeys()
+	if len(keys) == 0 {
+		return false
+	}
+	_, ok := keys[strings.ToLower(key)]
+	return ok
+}
+
+func (a *auditLog) redactSlice(valSlice []interface{}, path string) bool {
+	a.depth++
+	defer func() { a.depth-- }()
+
 	var changed bool
 	for i, v := range valSlice {
 		switch val := v.(type) {
 		case map[string]interface{}:
-			if a.redactMap(val) {
+			if a.depthExceeded() {
+				valSlice[i] = redactedDepthExceeded
+				a.addRedactedKey(fmt.Sprintf("%s[%d]", path, i))
+				changed = true
+				continue
+			}
+			if a.redactMap(val, fmt.Sprintf("%s[%d]", path, i)) {
 				changed = true
 				valSlice[i] = val
 			}
 		case string:
+			if a.isSensitiveValue(val) {
+				valSlice[i] = redacted
+				a.addRedactedKey(fmt.Sprintf("%s[%d]", path, i))
+				changed = true
+				continue
+			}
 			// this attempts to identify slices that represent commands of the format ["--<command>, <value>"], and
 			// redact value is command indicates it is sensitive.
 			if i+1 == len(valSlice) {
 				continue
 			}
-			if !strings.HasPrefix(val, "--") || !a.keysToRedactRegex.MatchString(val) {
+			if !strings.HasPrefix(val, "--") || a.keysToRedactRegex == nil || !a.keysToRedactRegex.MatchString(val) {
 				// not a sensitive option flag
 				continue
 			}
 			valSlice[i+1] = redacted
+			a.addRedactedKey(fmt.Sprintf("%s[%d]", path, i+1))
 			changed = true
 		}
 	}
 	return changed
 }
 
-func decompressGZIP(data []byte) ([]byte, error) {
+func decompressGZIP(data []byte, maxSize int) ([]byte, error) {
 	gz, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
 	}
 
-	return decompress(gz)
+	return decompress(gz, maxSize)
 }
 
-func decompressZLib(data []byte) ([]byte, error) {
+func decompressZLib(data []byte, maxSize int) ([]byte, error) {
 	zr, err := zlib.NewReader(bytes.NewReader(data))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create zlib reader: %w", err)
 	}
 
-	return decompress(zr)
+	return decompress(zr, maxSize)
 }
 
-func decompress(readCloser io.ReadCloser) ([]byte, error) {
-	rawData, err := ioutil.ReadAll(readCloser)
+// decompress reads the decompressed data, failing with errDecompressedTooLarge if maxSize is positive and there are
+// more than maxSize bytes of it, so that small compressed bodies cannot exhaust memory.
+func decompress(readCloser io.ReadCloser, maxSize int) ([]byte, error) {
+	var reader io.Reader = readCloser
+	if maxSize > 0 {
+		reader = io.LimitReader(readCloser, int64(maxSize)+1)
+	}
+	rawData, err := ioutil.ReadAll(reader)
+	if err == nil && maxSize > 0 && len(rawData) > maxSize {
+		err = errDecompressedTooLarge
+	}
 	if err != nil {
 		retErr := fmt.Errorf("failed to read compressed response: %w", err)
 		closeErr := readCloser.Close()
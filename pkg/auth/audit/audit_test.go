@@ -4,22 +4,35 @@
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rancher/rancher/pkg/data/management"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/encoding/protowire"
+	k8stypes "k8s.io/apimachinery/pkg/types"
 )
 
 var errAny = errors.New("any error is allowed")
 
+var updateGolden = flag.Bool("update", false, "update the golden files of TestRedactGolden")
+
 type AuditTest struct {
 	suite.Suite
 }
@@ -200,30 +213,784 @@ func (a *AuditTest) TestRedactSensitiveData() {
 			uri:   `asdf`,
 		},
 		{
-			name:  "With items from sensitiveBodyFields",
-			input: []byte(`{"credentials": "{'fakeCredName': 'fakeCred'}", "applicationSecret": "fakeAppSecret", "oauthCredential": "fakeOauth", "serviceAccountCredential": "fakeSACred", "spKey": "fakeSPKey", "spCert": "fakeSPCERT", "certificate": "fakeCert", "privateKey": "fakeKey"}`),
-			want:  []byte(fmt.Sprintf(`{"credentials": "%s", "applicationSecret": "%[1]s", "oauthCredential": "%[1]s", "serviceAccountCredential": "%[1]s", "spKey": "%[1]s", "spCert": "%[1]s", "certificate": "%[1]s", "privateKey": "%[1]s"}`, redacted)),
+			name:  "With items from sensitiveBodyFields",
+			input: []byte(`{"credentials": "{'fakeCredName': 'fakeCred'}", "applicationSecret": "fakeAppSecret", "oauthCredential": "fakeOauth", "serviceAccountCredential": "fakeSACred", "spKey": "fakeSPKey", "spCert": "fakeSPCERT", "certificate": "fakeCert", "privateKey": "fakeKey"}`),
+			want:  []byte(fmt.Sprintf(`{"credentials": "%s", "applicationSecret": "%[1]s", "oauthCredential": "%[1]s", "serviceAccountCredential": "%[1]s", "spKey": "%[1]s", "spCert": "%[1]s", "certificate": "%[1]s", "privateKey": "%[1]s"}`, redacted)),
+		},
+		{
+			name:  "With malformed input",
+			input: []byte(`{"key": "value", "response":}`),
+			want:  []byte(fmt.Sprintf(`{"%s": "invalid character '}' looking for beginning of value"}`, auditLogErrKey)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			var want map[string]interface{}
+			err := json.Unmarshal(test.want, &want)
+			a.NoError(err, "failed to unmarshal")
+			got := logger.redactSensitiveData(test.uri, test.input)
+			var gotMap map[string]interface{}
+			err = json.Unmarshal(got, &gotMap)
+			a.NoError(err, "failed to unmarshal")
+			a.Equal(want, gotMap, "redactSensitiveData() for map = %s, want %s", got, test.want)
+		})
+	}
+}
+func (a *AuditTest) TestRedactSensitiveDataFastPath() {
+	logger := auditLog{
+		writer: &LogWriter{
+			RedactKeys: map[string]struct{}{"apikey": {}},
+		},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name     string
+		uri      string
+		input    []byte
+		want     []byte
+		fastPath bool
+	}{
+		{
+			name:     "nothing to redact",
+			input:    []byte(`{"user": "fake_user", "data": [{"name": "fake_name"}]}`),
+			want:     []byte(`{"user": "fake_user", "data": [{"name": "fake_name"}]}`),
+			fastPath: true,
+		},
+		{
+			name:  "sensitive key",
+			input: []byte(`{"user": "fake_user", "password": "fake_password"}`),
+			want:  []byte(fmt.Sprintf(`{"user":"fake_user","password":"%s"}`, redacted)),
+		},
+		{
+			name:     "escaped characters in values",
+			input:    []byte(`{"user": "fake_user", "description": "a \"quoted\" password\n"}`),
+			want:     []byte(`{"user": "fake_user", "description": "a \"quoted\" password\n"}`),
+			fastPath: true,
+		},
+		{
+			name:  "sensitive command line flag",
+			input: []byte(`{"commands": ["--user", "fake_user", "--token", "fake_token"]}`),
+			want:  []byte(fmt.Sprintf(`{"commands":["--user","fake_user","--token","%s"]}`, redacted)),
+		},
+		{
+			name:  "sensitive key with escaped characters",
+			input: []byte(`{"user": "fake_user", "pass\u0077ord": "fake_password"}`),
+			want:  []byte(fmt.Sprintf(`{"user":"fake_user","password":"%s"}`, redacted)),
+		},
+		{
+			name:  "sensitive body field",
+			input: []byte(`{"user": "fake_user", "privateKey": "fake_key"}`),
+			want:  []byte(fmt.Sprintf(`{"user":"fake_user","privateKey":"%s"}`, redacted)),
+		},
+		{
+			name:  "redact key",
+			input: []byte(`{"user": "fake_user", "APIKey": "fake_key"}`),
+			want:  []byte(fmt.Sprintf(`{"user":"fake_user","APIKey":"%s"}`, redacted)),
+		},
+		{
+			name:  "secret uri",
+			uri:   "/v1/secrets",
+			input: []byte(`{"type": "Opaque", "data": {"foo": "YmFy"}}`),
+			want:  []byte(fmt.Sprintf(`{"type":"Opaque","data":"%s"}`, redacted)),
+		},
+		{
+			name:  "not an object",
+			input: []byte(`["fake_user"]`),
+			want:  []byte(fmt.Sprintf(`{"%s": "json: cannot unmarshal array into Go value of type map[string]interface {}"}`, auditLogErrKey)),
+		},
+		{
+			name:  "malformed input",
+			input: []byte(`{"key": "value", "response":}`),
+			want:  []byte(fmt.Sprintf(`{"%s": "invalid character '}' looking for beginning of value"}`, auditLogErrKey)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			a.Equal(!test.fastPath, logger.mayContainSensitiveData(test.uri, test.input) || !isJSONObject(test.input))
+			got := logger.redactSensitiveData(test.uri, test.input)
+			a.JSONEq(string(test.want), string(got))
+			// redaction must be the same as when always unmarshalling the body
+			a.JSONEq(string(logger.redactJSON(test.uri, test.input)), string(got))
+		})
+	}
+}
+
+func (a *AuditTest) TestMaxRedactDepth() {
+	sensitiveRegex, err := constructKeyRedactRegex()
+	a.Require().NoError(err)
+
+	nested := func(depth int) string {
+		return strings.Repeat(`{"a":`, depth) + `{"password":"hunter2"}` + strings.Repeat(`}`, depth)
+	}
+
+	logger := auditLog{keysToRedactRegex: sensitiveRegex, writer: &LogWriter{MaxRedactDepth: 3}}
+	got := logger.redactSensitiveData("/v3/test", []byte(`{"password":"hunter2","nested":`+nested(3)+`,"list":[`+nested(3)+`]}`))
+	a.JSONEq(`{
+		"password": "[redacted]",
+		"nested": {"a": {"a": "[redacted-depth-exceeded]"}},
+		"list": [{"a": "[redacted-depth-exceeded]"}]
+	}`, string(got))
+
+	// a pathologically nested body must not exhaust the stack with the default limit
+	logger = auditLog{keysToRedactRegex: sensitiveRegex}
+	a.NotPanics(func() {
+		got = logger.redactSensitiveData("/v3/test", []byte(`{"password":"hunter2","nested":`+nested(5000)+`}`))
+	})
+	a.Contains(string(got), redactedDepthExceeded)
+	a.NotContains(string(got), "hunter2")
+	a.Equal(defaultMaxRedactDepth, strings.Count(string(got), `{`), "Expected the objects up to the default depth to be kept")
+}
+
+func BenchmarkRedactSensitiveData(b *testing.B) {
+	sensitiveRegex, err := constructKeyRedactRegex()
+	if err != nil {
+		b.Fatalf("failed compiling sanitizing regex: %v", err)
+	}
+	logger := auditLog{keysToRedactRegex: sensitiveRegex}
+
+	var items []string
+	for i := 0; i < 100; i++ {
+		items = append(items, fmt.Sprintf(`{"id":"c-%[1]d","type":"cluster","name":"cluster-%[1]d","labels":{"env":"test"},"nodeCount":3}`, i))
+	}
+	body := []byte(`{"type":"collection","data":[` + strings.Join(items, ",") + `]}`)
+
+	b.Run("fast path", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			logger.redactSensitiveData("/v3/clusters", body)
+		}
+	})
+	b.Run("unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			logger.redactJSON("/v3/clusters", body)
+		}
+	})
+}
+
+func BenchmarkFormatJSON(b *testing.B) {
+	log := &log{
+		AuditID:           "1234",
+		RequestURI:        "/v3/clusters",
+		User:              &User{Name: "user-1", Group: []string{"system:authenticated"}},
+		Method:            http.MethodPost,
+		RequestTimestamp:  "2024-01-01T00:00:00Z",
+		ResponseTimestamp: "2024-01-01T00:00:01Z",
+		ResponseCode:      http.StatusCreated,
+		RequestHeader:     http.Header{"Content-Type": {contentTypeJSON}, "User-Agent": {"useragent1"}},
+	}
+	for _, size := range []int{0, 1 << 10, 64 << 10, 1 << 20} {
+		body := []byte(`{"data":"` + strings.Repeat("x", size) + `"}`)
+		b.Run(fmt.Sprintf("bodySize=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := formatJSON(log, body, body, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactSecretDataBase64() {
+	logger := auditLog{
+		writer:            &LogWriter{RedactSecretDataBase64: true},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name  string
+		uri   string
+		input []byte
+	}{
+		{
+			name:  "secret",
+			uri:   "/v1/secrets/default/my-secret",
+			input: []byte(`{"type":"Opaque","metadata":{"namespace":"default","name":"my-secret"},"data":{"foo":"c3VwZXIgc2VjcmV0IGRhdGE=","bar":"U3VwZXIgU2VjcmV0IERhdGEK"}}`),
+		},
+		{
+			name:  "secret list from k8s proxy",
+			uri:   "/k8s/clusters/local/api/v1/secrets?limit=500",
+			input: []byte(`{"kind":"SecretList","items":[{"type":"Opaque","metadata":{"namespace":"default","name":"my-secret"},"data":{"foo":"c3VwZXIgc2VjcmV0IGRhdGE="}}]}`),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			var got struct {
+				Data  map[string]string `json:"data"`
+				Items []struct {
+					Data map[string]string `json:"data"`
+				} `json:"items"`
+			}
+			a.Require().NoError(json.Unmarshal(logger.redactSensitiveData(test.uri, test.input), &got))
+
+			data := []map[string]string{got.Data}
+			if got.Items != nil {
+				data = nil
+				for _, item := range got.Items {
+					data = append(data, item.Data)
+				}
+			}
+			for _, d := range data {
+				a.NotEmpty(d)
+				for key, value := range d {
+					decoded, err := base64.StdEncoding.DecodeString(value)
+					a.NoErrorf(err, "value of key %s is not valid base64", key)
+					a.Equal(redacted, string(decoded))
+				}
+			}
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactLastAppliedConfig() {
+	logger := auditLog{
+		writer:            &LogWriter{},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name             string
+		uri              string
+		input            []byte
+		wantData         interface{}
+		wantLastApplied  interface{}
+		wantRedactedKeys []string
+	}{
+		{
+			name:             "secret",
+			uri:              "/v1/secrets/default/my-secret",
+			input:            []byte(`{"kind":"Secret","metadata":{"name":"my-secret","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"apiVersion\":\"v1\",\"data\":{\"foo\":\"c3VwZXIgc2VjcmV0\"},\"kind\":\"Secret\",\"metadata\":{\"name\":\"my-secret\"}}\n"}},"data":{"foo":"c3VwZXIgc2VjcmV0"}}`),
+			wantData:         redacted,
+			wantLastApplied:  map[string]interface{}{"apiVersion": "v1", "data": redacted, "kind": "Secret", "metadata": map[string]interface{}{"name": "my-secret"}},
+			wantRedactedKeys: []string{"data", "metadata.annotations.kubectl.kubernetes.io/last-applied-configuration.data"},
+		},
+		{
+			name:             "secret with string data",
+			uri:              "/v1/secrets/default/my-secret",
+			input:            []byte(`{"kind":"Secret","metadata":{"name":"my-secret","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"kind\":\"Secret\",\"stringData\":{\"foo\":\"super secret\"}}"}},"data":{"foo":"c3VwZXIgc2VjcmV0"}}`),
+			wantData:         redacted,
+			wantLastApplied:  map[string]interface{}{"kind": "Secret", "stringData": redacted},
+			wantRedactedKeys: []string{"data", "metadata.annotations.kubectl.kubernetes.io/last-applied-configuration.stringData"},
+		},
+		{
+			name:             "sensitive key of another object",
+			uri:              "/v1/apps.deployments/default/my-app",
+			input:            []byte(`{"kind":"Deployment","metadata":{"name":"my-app","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"kind\":\"Deployment\",\"spec\":{\"password\":\"super secret\"}}"}}}`),
+			wantLastApplied:  map[string]interface{}{"kind": "Deployment", "spec": map[string]interface{}{"password": redacted}},
+			wantRedactedKeys: []string{"metadata.annotations.kubectl.kubernetes.io/last-applied-configuration.spec.password"},
+		},
+		{
+			name:            "nothing to redact",
+			uri:             "/v1/apps.deployments/default/my-app",
+			input:           []byte(`{"kind":"Deployment","metadata":{"name":"my-app","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"kind\":\"Deployment\"}"}}}`),
+			wantLastApplied: map[string]interface{}{"kind": "Deployment"},
+		},
+		{
+			name:             "not JSON",
+			uri:              "/v1/apps.deployments/default/my-app",
+			input:            []byte(`{"kind":"Deployment","metadata":{"name":"my-app","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"password: super secret"}}}`),
+			wantLastApplied:  redacted,
+			wantRedactedKeys: []string{"metadata.annotations.kubectl.kubernetes.io/last-applied-configuration"},
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			logger.redactedKeys = nil
+			var got struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+				Data interface{} `json:"data"`
+			}
+			a.Require().NoError(json.Unmarshal(logger.redactSensitiveData(test.uri, test.input), &got))
+			a.Equal(test.wantData, got.Data)
+
+			lastApplied := got.Metadata.Annotations[lastAppliedConfigAnnotation]
+			var gotLastApplied interface{} = lastApplied
+			if lastApplied != redacted {
+				a.Require().NoError(json.Unmarshal([]byte(lastApplied), &gotLastApplied))
+			}
+			a.Equal(test.wantLastApplied, gotLastApplied)
+			a.ElementsMatch(test.wantRedactedKeys, logger.redactedKeys)
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactBase64Uploads() {
+	kubeconfig := base64.StdEncoding.EncodeToString([]byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: local
+  cluster:
+    server: https://rancher.example.com/k8s/clusters/local
+users:
+- name: local
+  user:
+    token: kubeconfig-user-abcde:secret
+`))
+	// Wrapped like the output of base64 without -w 0.
+	var wrapped []string
+	for s := kubeconfig; s != ""; {
+		n := min(76, len(s))
+		wrapped = append(wrapped, s[:n])
+		s = s[n:]
+	}
+
+	tests := []struct {
+		name    string
+		minSize int
+		input   map[string]interface{}
+		want    map[string]interface{}
+	}{
+		{
+			name:  "kubeconfig upload",
+			input: map[string]interface{}{"name": "kubeconfig.yaml", "file": kubeconfig},
+			want:  map[string]interface{}{"name": "kubeconfig.yaml", "file": redacted},
+		},
+		{
+			name:  "keys are matched case-insensitively",
+			input: map[string]interface{}{"Content": kubeconfig},
+			want:  map[string]interface{}{"Content": redacted},
+		},
+		{
+			name:  "wrapped lines",
+			input: map[string]interface{}{"file": strings.Join(wrapped, "\n")},
+			want:  map[string]interface{}{"file": redacted},
+		},
+		{
+			name:  "data URL",
+			input: map[string]interface{}{"file": "data:application/octet-stream;base64," + kubeconfig},
+			want:  map[string]interface{}{"file": redacted},
+		},
+		{
+			name:  "unconfigured key",
+			input: map[string]interface{}{"description": kubeconfig},
+			want:  map[string]interface{}{"description": kubeconfig},
+		},
+		{
+			name:  "shorter than the minimum size",
+			input: map[string]interface{}{"content": "aGVsbG8="},
+			want:  map[string]interface{}{"content": "aGVsbG8="},
+		},
+		{
+			name:    "configured minimum size",
+			minSize: 8,
+			input:   map[string]interface{}{"content": "aGVsbG8="},
+			want:    map[string]interface{}{"content": redacted},
+		},
+		{
+			name:  "not base64",
+			input: map[string]interface{}{"content": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a-configmap-with-a-long-name"},
+			want:  map[string]interface{}{"content": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a-configmap-with-a-long-name"},
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			logger := auditLog{
+				writer:            &LogWriter{Base64UploadKeys: []string{"file", "content"}, Base64UploadMinSize: test.minSize},
+				keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+			}
+			input, err := json.Marshal(test.input)
+			a.Require().NoError(err)
+
+			var got map[string]interface{}
+			a.Require().NoError(json.Unmarshal(logger.redactSensitiveData("/v3/clusters", input), &got))
+			a.Equal(test.want, got)
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactXML() {
+	tests := []struct {
+		name     string
+		input    string
+		want     string
+		wantKeys []string
+		wantErr  bool
+	}{
+		{
+			name:     "password element and token attribute",
+			input:    `<?xml version="1.0"?><user name="admin" token="abc"><password>secret</password></user>`,
+			want:     `<?xml version="1.0"?><user name="admin" token="[redacted]"><password>[redacted]</password></user>`,
+			wantKeys: []string{"user.@token", "user.password"},
+		},
+		{
+			name:     "elements nested in a sensitive element",
+			input:    `<session><token><value>abc</value><expires>1h</expires></token></session>`,
+			want:     `<session><token><value>[redacted]</value><expires>[redacted]</expires></token></session>`,
+			wantKeys: []string{"session.token"},
+		},
+		{
+			name:     "namespaces",
+			input:    `<ns:login xmlns:ns="urn:example"><ns:password>secret</ns:password></ns:login>`,
+			want:     `<ns:login xmlns:ns="urn:example"><ns:password>[redacted]</ns:password></ns:login>`,
+			wantKeys: []string{"login.password"},
+		},
+		{
+			name:  "nothing to redact",
+			input: `<user name="admin">  <password/></user>`,
+			want:  `<user name="admin">  <password/></user>`,
+		},
+		{
+			name:    "mismatched tags",
+			input:   `<user><password>secret</user>`,
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			input:   `<user><password>sec`,
+			wantErr: true,
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			logger := auditLog{keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`)}
+			got := logger.redactXML([]byte(test.input))
+			if test.wantErr {
+				a.NotContains(string(got), "secret")
+				var body map[string]interface{}
+				a.Require().NoError(json.Unmarshal(got, &body))
+				a.Contains(body, auditLogErrKey)
+				return
+			}
+			a.Equal(test.want, string(got))
+			a.Equal(test.wantKeys, logger.redactedKeys)
+		})
+	}
+
+	const body = `<login><username>admin</username><password>secret</password></login>`
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		rw.Write([]byte(`<session token="abc"/>`))
+	})
+	handler, _, tmpPath := a.newTestAuditHandler(LevelRequestResponse, next)
+	req := newTestRequest(http.MethodPost, "/v3/settings", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/xml")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	logs := a.readLogs(tmpPath)
+	a.Require().Len(logs, 1)
+	a.Equal(`<login><username>admin</username><password>[redacted]</password></login>`, logs[0]["requestBody"])
+	a.Equal(`<session token="[redacted]"></session>`, logs[0]["responseBody"])
+	a.ElementsMatch([]interface{}{"requestBody.login.password", "responseBody.session.@token"}, logs[0]["redactedKeys"])
+}
+
+func (a *AuditTest) TestRedactKeys() {
+	logger := auditLog{
+		writer: &LogWriter{
+			RedactKeys: map[string]struct{}{
+				"secret": {},
+				"apikey": {},
+			},
+		},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{
+			name:  "exact key",
+			input: []byte(`{"secret": "fake_secret", "user": "fake_user"}`),
+			want:  []byte(fmt.Sprintf(`{"secret":"%s","user":"fake_user"}`, redacted)),
+		},
+		{
+			name:  "exact key is case-insensitive",
+			input: []byte(`{"apiKey": "fake_key", "Secret": "fake_secret", "user": "fake_user"}`),
+			want:  []byte(fmt.Sprintf(`{"apiKey":"%s","Secret":"%[1]s","user":"fake_user"}`, redacted)),
+		},
+		{
+			name:  "exact key does not match substrings",
+			input: []byte(`{"secretName": "name", "user": "fake_user"}`),
+			want:  []byte(`{"secretName":"name","user":"fake_user"}`),
+		},
+		{
+			name:  "exact key and regex",
+			input: []byte(`{"nested": {"apikey": "fake_key", "accessToken": "fake_token"}, "password": "fake_password"}`),
+			want:  []byte(fmt.Sprintf(`{"nested":{"apikey":"%s","accessToken":"%[1]s"},"password":"%[1]s"}`, redacted)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			got := logger.redactSensitiveData("", test.input)
+			a.JSONEq(string(test.want), string(got))
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactGRPCGatewayBodies() {
+	regex, err := constructKeyRedactRegex()
+	a.Require().NoError(err)
+	logger := auditLog{keysToRedactRegex: regex}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{
+			name:  "original proto field names",
+			input: []byte(`{"cluster":{"name":"c-12345","auth_config":{"private_key":"fake_key","client_secret":"fake_secret","access_token":"fake_token","client_id":"id"}}}`),
+			want:  []byte(fmt.Sprintf(`{"cluster":{"name":"c-12345","auth_config":{"private_key":"%s","client_secret":"%[1]s","access_token":"%[1]s","client_id":"id"}}}`, redacted)),
+		},
+		{
+			name:  "json field names",
+			input: []byte(`{"cluster":{"name":"c-12345","authConfig":{"privateKey":"fake_key","clientSecret":"fake_secret","accessToken":"fake_token","clientId":"id"}}}`),
+			want:  []byte(fmt.Sprintf(`{"cluster":{"name":"c-12345","authConfig":{"privateKey":"%s","clientSecret":"%[1]s","accessToken":"%[1]s","clientId":"id"}}}`, redacted)),
+		},
+		{
+			name:  "kebab case field names",
+			input: []byte(`{"secret-key":"fake_secret","service-account-credential":"fake_credential","region":"us-west-2"}`),
+			want:  []byte(fmt.Sprintf(`{"secret-key":"%s","service-account-credential":"%[1]s","region":"us-west-2"}`, redacted)),
+		},
+		{
+			name:  "wrapper types",
+			input: []byte(`{"credential":{"password":{"value":"fake_password"},"username":{"value":"admin"}}}`),
+			want:  []byte(fmt.Sprintf(`{"credential":{"password":{"value":"%s"},"username":{"value":"admin"}}}`, redacted)),
+		},
+		{
+			name:  "oneof",
+			input: []byte(`{"auth":{"sp_key":{"pem":"fake_key"}},"source":{"git":{"url":"https://github.com/rancher/charts","token":"fake_token"}}}`),
+			want:  []byte(fmt.Sprintf(`{"auth":{"sp_key":{"pem":"%s"}},"source":{"git":{"url":"https://github.com/rancher/charts","token":"%[1]s"}}}`, redacted)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			got := logger.redactSensitiveData("", test.input)
+			a.JSONEq(string(test.want), string(got))
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactBearerTokens() {
+	regex, err := constructKeyRedactRegex()
+	a.Require().NoError(err)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		input   []byte
+		want    []byte
+	}{
+		{
+			name:  "authorization key",
+			input: []byte(`{"authorization": "Bearer token-abcde:fakesecret", "bearer": "fakesecret", "name": "test"}`),
+			want:  []byte(fmt.Sprintf(`{"authorization":"%s","bearer":"%[1]s","name":"test"}`, redacted)),
+		},
+		{
+			name:  "bearer value is kept by default",
+			input: []byte(`{"header": "Bearer token-abcde:fakesecret", "name": "test"}`),
+			want:  []byte(`{"header":"Bearer token-abcde:fakesecret","name":"test"}`),
+		},
+		{
+			name:    "bearer value",
+			enabled: true,
+			input:   []byte(`{"header": "Bearer token-abcde:fakesecret", "nested": {"value": "bearer eyJhbGciOiJIUzI1NiJ9.e30.fake"}, "name": "Bearer"}`),
+			want:    []byte(fmt.Sprintf(`{"header":"%s","nested":{"value":"%[1]s"},"name":"Bearer"}`, redacted)),
+		},
+		{
+			name:    "bearer value in a list",
+			enabled: true,
+			input:   []byte(`{"headers": ["Accept: */*", "Bearer fakesecret"]}`),
+			want:    []byte(fmt.Sprintf(`{"headers":["Accept: */*","%s"]}`, redacted)),
+		},
+		{
+			name:    "escaped bearer value",
+			enabled: true,
+			input:   []byte(`{"header": "Bearer\tfakesecret", "value": "\u0042earer fakesecret", "name": "test"}`),
+			want:    []byte(fmt.Sprintf(`{"header":"%s","value":"%[1]s","name":"test"}`, redacted)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			logger := auditLog{
+				writer:            &LogWriter{RedactBearerTokens: test.enabled},
+				keysToRedactRegex: regex,
+			}
+			got := logger.redactSensitiveData("", test.input)
+			a.JSONEq(string(test.want), string(got))
+		})
+	}
+}
+
+func (a *AuditTest) TestKeepKeys() {
+	logger := auditLog{
+		writer: &LogWriter{
+			RedactKeys:            map[string]struct{}{"apikey": {}},
+			KeepKeys:              map[string]struct{}{"passwordPolicyEnabled": {}, "apiKey": {}, "privateKey": {}},
+			RedactNonStringValues: true,
+		},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{
+			name:  "kept key matching the regex",
+			input: []byte(`{"passwordPolicyEnabled": true, "password": "fake_password"}`),
+			want:  []byte(fmt.Sprintf(`{"passwordPolicyEnabled":true,"password":"%s"}`, redacted)),
+		},
+		{
+			name:  "kept key is matched exactly",
+			input: []byte(`{"PasswordPolicyEnabled": true, "nested": {"passwordPolicyEnabled": false}}`),
+			want:  []byte(fmt.Sprintf(`{"PasswordPolicyEnabled":"%s","nested":{"passwordPolicyEnabled":false}}`, redacted)),
+		},
+		{
+			name:  "kept key from sensitive body fields",
+			input: []byte(`{"privateKey": "fake_key", "certificate": "fake_cert"}`),
+			want:  []byte(fmt.Sprintf(`{"privateKey":"fake_key","certificate":"%s"}`, redacted)),
+		},
+		{
+			name:  "redact keys take precedence",
+			input: []byte(`{"apiKey": "fake_key"}`),
+			want:  []byte(fmt.Sprintf(`{"apiKey":"%s"}`, redacted)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			got := logger.redactSensitiveData("", test.input)
+			a.JSONEq(string(test.want), string(got))
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactFunc() {
+	var seen []interface{}
+	logger := auditLog{
+		writer: &LogWriter{
+			RedactKeyValuePairs: true,
+			// Redact any key ending in Token, unless it is csrfToken.
+			RedactFunc: func(key string, value interface{}) bool {
+				seen = append(seen, value)
+				return strings.HasSuffix(key, "Token") && key != "csrfToken"
+			},
+		},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{
+			name:  "selective redaction",
+			input: []byte(`{"accessToken": "fake_token", "csrfToken": "fake_csrf", "token": "fake", "nested": {"refreshToken": "fake_refresh", "name": "test"}}`),
+			want:  []byte(fmt.Sprintf(`{"accessToken":"%s","csrfToken":"fake_csrf","token":"fake","nested":{"refreshToken":"%[1]s","name":"test"}}`, redacted)),
+		},
+		{
+			name:  "non-string values",
+			input: []byte(`{"expiresToken": 3600, "enabledToken": true}`),
+			want:  []byte(fmt.Sprintf(`{"expiresToken":"%s","enabledToken":"%[1]s"}`, redacted)),
+		},
+		{
+			name:  "already redacted values",
+			input: []byte(`{"key": "password", "value": "fake_password"}`),
+			want:  []byte(fmt.Sprintf(`{"key":"password","value":"%s"}`, redacted)),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			seen = nil
+			got := logger.redactSensitiveData("", test.input)
+			a.JSONEq(string(test.want), string(got))
+			a.NotContains(seen, redacted, "RedactFunc should not be called with redacted values")
+		})
+	}
+}
+
+func (a *AuditTest) TestRedactNonStringValues() {
+	logger := auditLog{
+		writer:            &LogWriter{RedactKeys: map[string]struct{}{"otp": {}, "pin": {}}, RedactNonStringValues: true},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+	}{
+		{
+			name:  "numeric values",
+			input: []byte(`{"otp": 123456, "pin": 12.5, "port": 443}`),
+			want:  []byte(fmt.Sprintf(`{"otp":"%s","pin":"%[1]s","port":443}`, redacted)),
+		},
+		{
+			name:  "boolean values",
+			input: []byte(`{"nested": {"token": true}, "enabled": false}`),
+			want:  []byte(fmt.Sprintf(`{"nested":{"token":"%s"},"enabled":false}`, redacted)),
+		},
+		{
+			name:  "null values are kept",
+			input: []byte(`{"password": null}`),
+			want:  []byte(`{"password":null}`),
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			got := logger.redactSensitiveData("", test.input)
+			a.JSONEq(string(test.want), string(got))
+		})
+	}
+
+	// Numbers and booleans are kept by default.
+	logger.writer.RedactNonStringValues = false
+	const input = `{"otp":123456,"tokenTTL":3600,"passwordSet":true,"password":"fake_password"}`
+	got := logger.redactSensitiveData("", []byte(input))
+	a.JSONEq(fmt.Sprintf(`{"otp":123456,"tokenTTL":3600,"passwordSet":true,"password":"%s"}`, redacted), string(got))
+}
+
+func (a *AuditTest) TestRedactKeyValuePairs() {
+	input := []byte(`{"answers":[{"key":"db.password","value":"hunter2"},{"key":"db.name","value":"rancher"}],"key":"token","value":"fake_token"}`)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    []byte
+	}{
+		{
+			name:    "disabled",
+			enabled: false,
+			want:    input,
 		},
 		{
-			name:  "With malformed input",
-			input: []byte(`{"key": "value", "response":}`),
-			want:  []byte(fmt.Sprintf(`{"%s": "invalid character '}' looking for beginning of value"}`, auditLogErrKey)),
+			name:    "enabled",
+			enabled: true,
+			want:    []byte(fmt.Sprintf(`{"answers":[{"key":"db.password","value":"%s"},{"key":"db.name","value":"rancher"}],"key":"token","value":"%[1]s"}`, redacted)),
 		},
 	}
 	for i := range tests {
 		test := tests[i]
 		a.Run(test.name, func() {
-			var want map[string]interface{}
-			err := json.Unmarshal(test.want, &want)
-			a.NoError(err, "failed to unmarshal")
-			got := logger.redactSensitiveData(test.uri, test.input)
-			var gotMap map[string]interface{}
-			err = json.Unmarshal(got, &gotMap)
-			a.NoError(err, "failed to unmarshal")
-			a.Equal(want, gotMap, "redactSensitiveData() for map = %s, want %s", got, test.want)
+			logger := auditLog{
+				writer:            &LogWriter{RedactKeyValuePairs: test.enabled},
+				keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+			}
+			got := logger.redactSensitiveData("", input)
+			a.JSONEq(string(test.want), string(got))
 		})
 	}
 }
+
 func (a *AuditTest) TestCompression() {
 	// Create a temp log file
 	tmpFile, err := os.CreateTemp("", "audit-test")
@@ -261,15 +1028,18 @@ func (a *AuditTest) TestCompression() {
 		returnCode       int
 		expectedRespBody string
 		expectedReqBody  string
+		expectedOmitted  string
 		level            Level
 		Error            error
 	}{
 		{
-			name:       "invalid Encoding",
-			respHeader: http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"bzip2"}},
-			respBody:   []byte(testString),
-			Error:      ErrUnsupportedEncoding,
-			level:      LevelRequestResponse,
+			name:            "invalid Encoding",
+			respHeader:      http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"bzip2"}},
+			respBody:        []byte(testString),
+			reqBody:         []byte(testString2),
+			expectedReqBody: testString2,
+			expectedOmitted: bodyOmittedReasonEncoding,
+			level:           LevelRequestResponse,
 		},
 		{
 			name:             "none encoding",
@@ -332,18 +1102,18 @@ func (a *AuditTest) TestCompression() {
 			level:            LevelRequestResponse,
 		},
 		{
-			name:       "invalid gzip response",
-			respHeader: http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"gzip"}},
-			respBody:   []byte(testString),
-			Error:      errAny,
-			level:      LevelRequestResponse,
+			name:             "invalid gzip response",
+			respHeader:       http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"gzip"}},
+			respBody:         []byte(testString),
+			expectedRespBody: `{"auditLogError":"failed to decode response: failed to create gzip reader: gzip: invalid header"}`,
+			level:            LevelRequestResponse,
 		},
 		{
-			name:       "invalid deflate response",
-			respHeader: http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"deflate"}},
-			respBody:   []byte(testString),
-			Error:      errAny,
-			level:      LevelRequestResponse,
+			name:             "invalid deflate response",
+			respHeader:       http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"deflate"}},
+			respBody:         []byte(testString),
+			expectedRespBody: `{"auditLogError":"failed to decode response: failed to create zlib reader: zlib: invalid header"}`,
+			level:            LevelRequestResponse,
 		},
 		{
 			name:             "invalid json gzip response",
@@ -364,7 +1134,7 @@ func (a *AuditTest) TestCompression() {
 	for i := range tests {
 		test := tests[i]
 		a.Run(test.name, func() {
-			writer.Level = test.level
+			writer.SetLevel(test.level)
 			auditLog.reqBody = []byte(test.reqBody)
 			// write the test to the audit logger
 			err := auditLog.write(nil, req.Header, test.respHeader, test.returnCode, test.respBody)
@@ -383,6 +1153,7 @@ func (a *AuditTest) TestCompression() {
 			// validate the json written to the file is as expected\
 
 			expectedData := a.addMeta(auditLog.log, nil, test.respHeader, test.expectedReqBody, test.expectedRespBody)
+			a.Equal(test.expectedOmitted, auditLog.log.BodyOmittedReason)
 
 			a.JSONEqf(expectedData, a.drain(tmpPath), "Incorrect JSON stored.")
 		})
@@ -480,12 +1251,17 @@ func (a *AuditTest) TestFilterSensitiveHeader() {
 			respHeader:         http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"none"}, "X-Api-Set-Cookie-Header": []string{"abcd"}},
 			expectedRespHeader: http.Header{"Content-Type": []string{"application/json"}, "Content-Encoding": []string{"none"}},
 		},
+		{
+			name:               "sensitive query parameter in response header: \"Location\"",
+			respHeader:         http.Header{"Content-Type": []string{"application/json"}, "Location": []string{"https://rancher.example.com/dashboard/auth/verify?state=abcd&token=efgh"}},
+			expectedRespHeader: http.Header{"Content-Type": []string{"application/json"}, "Location": []string{"https://rancher.example.com/dashboard/auth/verify?state=abcd&token=" + redacted}},
+		},
 	}
-	writer.Level = LevelMetadata
+	writer.SetLevel(LevelMetadata)
 	for i := range tests {
 		test := tests[i]
 		a.Run(test.name, func() {
-			writer.Level = 1
+			writer.SetLevel(1)
 			// write the test to the audit logger
 			auditLog.log.RequestHeader = test.reqHeader
 			err := auditLog.write(nil, test.reqHeader, test.respHeader, 0, []byte{})
@@ -501,6 +1277,759 @@ func (a *AuditTest) TestFilterSensitiveHeader() {
 	}
 }
 
+func (a *AuditTest) TestAllowedHeaders() {
+	tmpFile, err := os.CreateTemp("", "audit-test")
+	a.Require().NoError(err, "Failed to create temp directory.")
+	err = tmpFile.Close()
+	a.Require().NoError(err, "Failed to close temporary file after creation")
+
+	tmpPath := tmpFile.Name()
+	defer func() {
+		err = os.RemoveAll(tmpPath)
+		a.NoError(err, "Failed to clean up temp directory")
+	}()
+
+	writer := NewLogWriter(tmpPath, LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	writer.AllowedHeaders = []string{"user-agent", "X-Rancher-Version", "Content-Length", "Authorization", "Set-Cookie"}
+
+	req, err := http.NewRequest(http.MethodGet, "/test", nil)
+	a.Require().NoErrorf(err, "Failed to create request: %v", err)
+
+	auditLog, err := newAuditLog(writer, req, regexp.MustCompile(`[pP]assword|[tT]oken`))
+	a.Require().NoErrorf(err, "Failed to create AuditLog: %v", err)
+
+	reqHeader := http.Header{
+		"User-Agent":    []string{"useragent1"},
+		"Authorization": []string{"Bearer abcd"},
+		"Accept":        []string{"application/json"},
+	}
+	respHeader := http.Header{
+		"Content-Type":      []string{"application/json"},
+		"Content-Length":    []string{"2"},
+		"X-Rancher-Version": []string{"v2.9.0"},
+		"Set-Cookie":        []string{"R_SESS=abcd"},
+	}
+	err = auditLog.write(nil, reqHeader, respHeader, 0, nil)
+	a.Require().NoErrorf(err, "Failed to write log: %v.", err)
+
+	expectedReqHeader := http.Header{"User-Agent": []string{"useragent1"}}
+	expectedRespHeader := http.Header{"Content-Length": []string{"2"}, "X-Rancher-Version": []string{"v2.9.0"}}
+	a.JSONEq(a.addMeta(auditLog.log, expectedReqHeader, expectedRespHeader, "", ""), a.drain(tmpPath))
+}
+
+func (a *AuditTest) TestRedactHeaderQueries() {
+	logger := auditLog{
+		writer:            &LogWriter{},
+		keysToRedactRegex: regexp.MustCompile(`[pP]assword|[tT]oken`),
+	}
+
+	tests := []struct {
+		name         string
+		queryHeaders []string
+		header       http.Header
+		want         http.Header
+	}{
+		{
+			name:   "location with token",
+			header: http.Header{"Location": []string{"/v3/verify?token=abcd"}},
+			want:   http.Header{"Location": []string{"/v3/verify?token=" + redacted}},
+		},
+		{
+			name:   "location with escaped key and fragment",
+			header: http.Header{"Location": []string{"https://rancher.example.com/login?user=admin&access%54oken=abcd#top"}},
+			want:   http.Header{"Location": []string{"https://rancher.example.com/login?user=admin&accessToken=" + redacted + "#top"}},
+		},
+		{
+			name:   "location without query",
+			header: http.Header{"Location": []string{"https://rancher.example.com/dashboard"}},
+			want:   http.Header{"Location": []string{"https://rancher.example.com/dashboard"}},
+		},
+		{
+			name:         "configured header",
+			queryHeaders: []string{"x-redirect"},
+			header:       http.Header{"Location": []string{"/verify?token=abcd"}, "X-Redirect": []string{"/verify?password=abcd"}},
+			want:         http.Header{"Location": []string{"/verify?token=abcd"}, "X-Redirect": []string{"/verify?password=" + redacted}},
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		a.Run(test.name, func() {
+			logger.writer.RedactQueryHeaders = test.queryHeaders
+			original := test.header.Clone()
+			filtered, _ := filterOutHeaders(test.header, sensitiveResponseHeader, 0)
+			got := logger.redactHeaderQueries(filtered)
+			a.Equal(test.want, got)
+			a.Equal(original, test.header, "response headers should not be modified")
+		})
+	}
+}
+
+func (a *AuditTest) TestNodeName() {
+	tmpFile, err := os.CreateTemp("", "audit-test")
+	a.Require().NoError(err, "Failed to create temp directory.")
+	err = tmpFile.Close()
+	a.Require().NoError(err, "Failed to close temporary file after creation")
+
+	tmpPath := tmpFile.Name()
+	defer func() {
+		err = os.RemoveAll(tmpPath)
+		a.NoError(err, "Failed to clean up temp directory")
+	}()
+
+	a.T().Setenv(nodeNameEnv, "rancher-0")
+
+	writer := NewLogWriter(tmpPath, LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	a.Equal("rancher-0", writer.Node)
+
+	req, err := http.NewRequest(http.MethodGet, "/test", nil)
+	a.Require().NoErrorf(err, "Failed to create request: %v", err)
+
+	auditLog, err := newAuditLog(writer, req, regexp.MustCompile(`[pP]assword|[tT]oken`))
+	a.Require().NoErrorf(err, "Failed to create AuditLog: %v", err)
+
+	err = auditLog.write(nil, req.Header, http.Header{}, 0, nil)
+	a.Require().NoErrorf(err, "Failed to write log: %v.", err)
+
+	var got map[string]interface{}
+	a.Require().NoError(json.Unmarshal([]byte(a.drain(tmpPath)), &got))
+	a.Equal("rancher-0", got["node"])
+}
+
+func (a *AuditTest) TestUserHeader() {
+	user := &User{
+		Name:          "user-1",
+		Group:         []string{"system:authenticated"},
+		Extra:         map[string][]string{"username": {"admin"}},
+		RequestUser:   "user-2",
+		RequestGroups: []string{"group-1"},
+	}
+
+	header := http.Header{}
+	a.Require().NoError(SetUserHeader(header, user))
+
+	ctx, err := WithUserFromHeader(context.Background(), header)
+	a.Require().NoError(err)
+	got, ok := FromContext(ctx)
+	a.Require().True(ok, "Expected the user to be in the context")
+	a.Equal(user, got)
+
+	ctx, err = WithUserFromHeader(context.Background(), http.Header{})
+	a.Require().NoError(err)
+	_, ok = FromContext(ctx)
+	a.False(ok, "Expected no user in the context without the header")
+
+	header.Set(UserHeader, "not base64")
+	_, err = WithUserFromHeader(context.Background(), header)
+	a.Error(err)
+}
+
+// TestRedactGolden redacts the bodies of the fixtures in testdata/redact and compares them with their golden files.
+// Each <name>.input fixture holds the request URI on its first line followed by the body, and <name>.golden the
+// expected redacted body. Run the test with -update to regenerate the golden files after an intended change.
+func (a *AuditTest) TestRedactGolden() {
+	redactRegex, err := constructKeyRedactRegex()
+	a.Require().NoError(err)
+	writer := &LogWriter{RedactBearerTokens: true, RedactNonStringValues: true}
+
+	inputs, err := filepath.Glob(filepath.Join("testdata", "redact", "*.input"))
+	a.Require().NoError(err)
+	a.Require().NotEmpty(inputs, "No fixtures found")
+
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".input")
+		a.Run(name, func() {
+			data, err := os.ReadFile(input)
+			a.Require().NoError(err)
+			uri, body, _ := strings.Cut(string(data), "\n")
+			got := redactBody(writer, redactRegex, uri, []byte(strings.TrimSuffix(body, "\n")))
+
+			golden := strings.TrimSuffix(input, ".input") + ".golden"
+			if *updateGolden {
+				a.Require().NoError(os.WriteFile(golden, got, 0644))
+			}
+			want, err := os.ReadFile(golden)
+			a.Require().NoError(err, "Failed to read the golden file, run the test with -update to create it")
+			a.Equal(string(want), string(got))
+		})
+	}
+}
+
+// shortWriter writes at most n bytes.
+type shortWriter struct {
+	n int
+}
+
+func (s shortWriter) Write(p []byte) (int, error) {
+	return min(s.n, len(p)), nil
+}
+
+func (a *AuditTest) TestFormatJSON() {
+	tests := []struct {
+		name    string
+		reqBody []byte
+		resBody []byte
+		want    string
+	}{
+		{
+			name:    "JSON bodies",
+			reqBody: []byte(`{"name": "test"}`),
+			resBody: []byte(`[1, 2]`),
+			want:    `{"auditID":"1234","mutating":false,"requestBody":{"name":"test"},"responseBody":[1,2]}`,
+		},
+		{
+			name:    "non-JSON bodies",
+			reqBody: []byte(`{"invalid":`),
+			resBody: []byte("plain \"text\"\n"),
+			want:    `{"auditID":"1234","mutating":false,"requestBody":"{\"invalid\":","responseBody":"plain \"text\"\n"}`,
+		},
+		{
+			name: "empty bodies",
+			want: `{"auditID":"1234","mutating":false}`,
+		},
+	}
+	for _, test := range tests {
+		a.Run(test.name, func() {
+			for _, pretty := range []bool{false, true} {
+				entry, err := formatJSON(&log{AuditID: "1234"}, test.reqBody, test.resBody, pretty)
+				a.Require().NoError(err)
+				a.True(json.Valid(entry), "The record should be valid JSON")
+				a.True(strings.HasSuffix(string(entry), "}\n"))
+				a.JSONEq(test.want, string(entry))
+				if !pretty {
+					a.Equal(test.want+"\n", string(entry))
+				}
+			}
+		})
+	}
+}
+
+func (a *AuditTest) TestWriteErrors() {
+	err := writeEntry(shortWriter{n: 5}, []byte(`{"auditID":"1234"}`))
+	a.ErrorIs(err, ErrTruncated)
+	a.NotErrorIs(err, ErrSinkWrite)
+
+	a.NoError(writeEntry(shortWriter{n: 100}, []byte(`{"auditID":"1234"}`)))
+
+	// The parent of the log path is a file, so the log cannot be written even when running as root.
+	notADir := filepath.Join(a.T().TempDir(), "file")
+	a.Require().NoError(os.WriteFile(notADir, nil, 0400))
+	writer := NewLogWriter(filepath.Join(notADir, "audit.log"), LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+
+	req, err := http.NewRequest(http.MethodGet, "/test", nil)
+	a.Require().NoErrorf(err, "Failed to create request: %v", err)
+	auditLog, err := newAuditLog(writer, req, regexp.MustCompile(`[pP]assword|[tT]oken`))
+	a.Require().NoErrorf(err, "Failed to create AuditLog: %v", err)
+
+	err = auditLog.write(nil, req.Header, http.Header{}, http.StatusOK, nil)
+	a.ErrorIs(err, ErrSinkWrite)
+	a.NotErrorIs(err, ErrMarshal)
+}
+
+func (a *AuditTest) TestFallback() {
+	// The parent of the log path is a file, so the log cannot be written even when running as root.
+	notADir := filepath.Join(a.T().TempDir(), "file")
+	a.Require().NoError(os.WriteFile(notADir, nil, 0400))
+	writer := NewLogWriter(filepath.Join(notADir, "audit.log"), LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	var fallback bytes.Buffer
+	writer.Fallback = &fallback
+
+	write := func(uri string) error {
+		req := httptest.NewRequest(http.MethodGet, uri, nil)
+		auditLog, err := newAuditLog(writer, req, regexp.MustCompile(`[pP]assword|[tT]oken`))
+		a.Require().NoError(err)
+		return auditLog.write(nil, req.Header, http.Header{}, http.StatusOK, nil)
+	}
+
+	a.NoError(write("/v3/clusters/1"))
+	a.NoError(write("/v3/clusters/2"))
+	var uris []string
+	for decoder := json.NewDecoder(&fallback); decoder.More(); {
+		var log log
+		a.Require().NoError(decoder.Decode(&log))
+		uris = append(uris, log.RequestURI)
+	}
+	a.Equal([]string{"/v3/clusters/1", "/v3/clusters/2"}, uris)
+	a.Equal(2, writer.WriteFailures())
+	a.Equal(0, writer.FallbackFailures())
+
+	// Records are lost only if the fallback fails too.
+	writer.Fallback = shortWriter{n: 0}
+	err := write("/v3/clusters/3")
+	a.ErrorIs(err, ErrSinkWrite)
+	a.ErrorIs(err, ErrTruncated)
+	a.Equal(3, writer.WriteFailures())
+	a.Equal(1, writer.FallbackFailures())
+
+	// Sinks fall back too.
+	fallback.Reset()
+	writer.Fallback = &fallback
+	writer.Sinks = []Sink{{Output: shortWriter{n: 0}, Level: LevelMetadata}}
+	a.NoError(write("/v3/clusters/4"))
+	a.Contains(fallback.String(), "/v3/clusters/4")
+	a.Equal(4, writer.WriteFailures())
+}
+
+func (a *AuditTest) TestProbe() {
+	tmpDir := a.T().TempDir()
+
+	writer := NewLogWriter(filepath.Join(tmpDir, "audit.log"), LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	a.NoError(writer.Probe())
+	data, err := os.ReadFile(filepath.Join(tmpDir, "audit.log"))
+	a.NoError(err, "Probe should create the log file")
+	a.Empty(data, "Probe should not write any data")
+	a.NoError(writer.Output.Close())
+
+	// The parent of the log path is a file, so the log cannot be created even when running as root.
+	notADir := filepath.Join(tmpDir, "file")
+	a.Require().NoError(os.WriteFile(notADir, nil, 0400))
+	writer = NewLogWriter(filepath.Join(notADir, "audit.log"), LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	a.Error(writer.Probe())
+
+	var nilWriter *LogWriter
+	a.NoError(nilWriter.Probe())
+}
+
+func (a *AuditTest) TestReopen() {
+	handler, writer, tmpPath := a.newTestAuditHandler(LevelMetadata, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+	rotatedPath := tmpPath + ".1"
+	a.T().Cleanup(func() { os.Remove(rotatedPath) })
+
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v3/clusters/1", nil))
+	a.Require().NoError(os.Rename(tmpPath, rotatedPath))
+	a.Require().NoError(writer.Reopen())
+	handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v3/clusters/2", nil))
+
+	rotatedLogs := a.readLogs(rotatedPath)
+	a.Require().Len(rotatedLogs, 1)
+	a.Equal("/v3/clusters/1", rotatedLogs[0]["requestURI"])
+	logs := a.readLogs(tmpPath)
+	a.Require().Len(logs, 1, "Records written after reopening should be in a new file")
+	a.Equal("/v3/clusters/2", logs[0]["requestURI"])
+
+	// The output is reopened when the process is signaled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	writer.ReopenOnSignal(ctx)
+	a.Require().NoError(os.Rename(tmpPath, rotatedPath))
+	process, err := os.FindProcess(os.Getpid())
+	a.Require().NoError(err)
+	a.Require().NoError(process.Signal(syscall.SIGHUP))
+	a.Eventually(func() bool {
+		handler.ServeHTTP(httptest.NewRecorder(), newTestRequest(http.MethodGet, "/v3/clusters/3", nil))
+		_, err := os.Stat(tmpPath)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "Records written after the signal should be in a new file")
+
+	var nilWriter *LogWriter
+	a.NoError(nilWriter.Reopen())
+}
+
+func (a *AuditTest) TestLevelString() {
+	tests := map[int]string{
+		0: "Null",
+		1: "Metadata",
+		2: "Request",
+		3: "RequestResponse",
+		4: "Level(4)",
+	}
+	for level, want := range tests {
+		a.Equal(want, Level(level).String())
+
+		writer := &LogWriter{}
+		writer.SetLevel(Level(level))
+		a.Equal(want, writer.LevelString())
+	}
+
+	var nilWriter *LogWriter
+	a.Equal("Null", nilWriter.LevelString())
+}
+
+func (a *AuditTest) TestSetLevel() {
+	tmpFile, err := os.CreateTemp("", "audit-test")
+	a.Require().NoError(err, "Failed to create temp directory.")
+	err = tmpFile.Close()
+	a.Require().NoError(err, "Failed to close temporary file after creation")
+
+	tmpPath := tmpFile.Name()
+	defer func() {
+		err = os.RemoveAll(tmpPath)
+		a.NoError(err, "Failed to clean up temp directory")
+	}()
+
+	writer := NewLogWriter(tmpPath, LevelMetadata, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	a.Equal(LevelMetadata, writer.GetLevel())
+
+	// Writers created without NewLogWriter start at their Level, until it is changed, even to LevelNull.
+	literal := &LogWriter{Level: LevelRequest}
+	a.Equal(LevelRequest, literal.GetLevel())
+	literal.SetLevel(LevelNull)
+	a.Equal(LevelNull, literal.GetLevel())
+	a.Equal(LevelRequest, literal.Level)
+
+	sensitiveRegex := regexp.MustCompile(`[pP]assword|[tT]oken`)
+	const reqBody = `{"test":"request"}`
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "/test", strings.NewReader(reqBody))
+		a.Require().NoErrorf(err, "Failed to create request: %v", err)
+		req.Header.Set("Content-Type", contentTypeJSON)
+		return req
+	}
+
+	// Flip the level while requests are being audited, this is expected to be run with -race.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			writer.SetLevel(Level(i%3 + 1))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			auditLog, err := newAuditLog(writer, newRequest(), sensitiveRegex)
+			a.NoError(err)
+			a.NoError(auditLog.write(nil, http.Header{}, http.Header{}, http.StatusOK, nil))
+		}
+	}()
+	wg.Wait()
+	a.drain(tmpPath)
+
+	for _, level := range []Level{LevelMetadata, LevelRequest} {
+		writer.SetLevel(level)
+		a.Equal(level, writer.GetLevel())
+
+		req := newRequest()
+		auditLog, err := newAuditLog(writer, req, sensitiveRegex)
+		a.Require().NoErrorf(err, "Failed to create AuditLog: %v", err)
+		err = auditLog.write(nil, req.Header, http.Header{}, http.StatusOK, nil)
+		a.Require().NoErrorf(err, "Failed to write log: %v.", err)
+
+		var got map[string]interface{}
+		a.Require().NoError(json.Unmarshal([]byte(a.drain(tmpPath)), &got))
+		_, ok := got["requestBody"]
+		a.Equalf(level >= LevelRequest, ok, "requestBody presence does not match level %d", level)
+	}
+}
+
+func (a *AuditTest) TestPretty() {
+	var compact, pretty bytes.Buffer
+	writer := &LogWriter{
+		Sinks: []Sink{{Output: &compact, Level: LevelRequestResponse}},
+		Clock: func() time.Time { return time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC) },
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "/v3/users", strings.NewReader(`{"name":"user","password":"fake_password"}`))
+	a.Require().NoErrorf(err, "Failed to create request: %v", err)
+	req.Header.Set("Content-Type", contentTypeJSON)
+
+	auditLog, err := newAuditLog(writer, req, regexp.MustCompile(`[pP]assword|[tT]oken`))
+	a.Require().NoErrorf(err, "Failed to create AuditLog: %v", err)
+
+	respHeader := http.Header{"Content-Type": []string{contentTypeJSON}}
+	const respBody = `{"name":"user","token":"fake_token"}`
+	a.Require().NoError(auditLog.write(&User{Name: "user-1"}, req.Header, respHeader, http.StatusCreated, []byte(respBody)))
+
+	writer.Pretty = true
+	writer.Sinks[0].Output = &pretty
+	// write two records to check that they can be read back one after the other
+	for i := 0; i < 2; i++ {
+		a.Require().NoError(auditLog.write(&User{Name: "user-1"}, req.Header, respHeader, http.StatusCreated, []byte(respBody)))
+	}
+
+	a.Equal(1, strings.Count(compact.String(), "\n"), "Compact records must be written on a single line")
+	a.Greater(strings.Count(pretty.String(), "\n"), 2, "Pretty records must be indented over multiple lines")
+
+	var want map[string]interface{}
+	a.Require().NoError(json.Unmarshal(compact.Bytes(), &want))
+	decoder := json.NewDecoder(&pretty)
+	for i := 0; i < 2; i++ {
+		var got map[string]interface{}
+		a.Require().NoError(decoder.Decode(&got))
+		a.Equal(want, got)
+	}
+	a.False(decoder.More(), "Expected exactly two records")
+}
+
+func (a *AuditTest) TestProtobufFormat() {
+	tmpFile, err := os.CreateTemp("", "audit-test")
+	a.Require().NoError(err, "Failed to create temp directory.")
+	err = tmpFile.Close()
+	a.Require().NoError(err, "Failed to close temporary file after creation")
+
+	tmpPath := tmpFile.Name()
+	defer func() {
+		err = os.RemoveAll(tmpPath)
+		a.NoError(err, "Failed to clean up temp directory")
+	}()
+
+	writer := NewLogWriter(tmpPath, LevelRequestResponse, 30, 30, 100)
+	a.Require().NotNil(writer, "Failed to create auditWriter.")
+	writer.Format = FormatProtobuf
+	writer.ReportRedactStats = true
+	writer.Labels = map[string]string{"environment": "test", "region": "eu-west-1"}
+	writer.RecordQueryParams = true
+
+	req, err := http.NewRequest(http.MethodPost, "/api/v1/namespaces/default/configmaps/test?dryRun=All&token=abcd", strings.NewReader(`{"user":"fake_user","password":"fake_password"}`))
+	a.Require().NoErrorf(err, "Failed to create request: %v", err)
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set("User-Agent", "useragent1")
+	req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}
+
+	auditLog, err := newAuditLog(writer, req, regexp.MustCompile(`[pP]assword|[tT]oken`))
+	a.Require().NoErrorf(err, "Failed to create AuditLog: %v", err)
+
+	user := &User{
+		Name:      "user-1",
+		Group:     []string{"system:authenticated", "group-1"},
+		Extra:     map[string][]string{"principalid": {"local://user-1"}},
+		AuthToken: "token-abcde",
+		UID:       "u-abcde",
+	}
+	respHeader := http.Header{"Content-Type": []string{contentTypeJSON}}
+	const respBody = `{"test":"response","accessToken":"fake_token"}`
+
+	// write two records to check the length prefixed framing
+	for i := 0; i < 2; i++ {
+		err = auditLog.write(user, req.Header, respHeader, http.StatusCreated, []byte(respBody))
+		a.Require().NoErrorf(err, "Failed to write log: %v.", err)
+	}
+
+	data := []byte(a.drain(tmpPath))
+	for i := 0; i < 2; i++ {
+		record, n := protowire.ConsumeBytes(data)
+		a.Require().GreaterOrEqualf(n, 0, "Failed to read length prefixed record: %v", protowire.ParseError(n))
+		data = data[n:]
+
+		got, reqBody, resBody := a.unmarshalProtobuf(record)
+		a.Equal(auditLog.log, got)
+		a.JSONEq(fmt.Sprintf(`{"user":"fake_user","password":"%s"}`, redacted), string(reqBody))
+		a.JSONEq(fmt.Sprintf(`{"test":"response","accessToken":"%s"}`, redacted), string(resBody))
+	}
+	a.Empty(data, "Unexpected trailing data")
+}
+
+// unmarshalProtobuf decodes an AuditLog protobuf message.
+func (a *AuditTest) unmarshalProtobuf(b []byte) (got *log, reqBody, resBody []byte) {
+	got = &log{}
+	a.consumeProtoFields(b, func(num protowire.Number, v []byte, varint uint64) {
+		switch num {
+		case protoAuditIDField:
+			got.AuditID = k8stypes.UID(v)
+		case protoRequestURIField:
+			got.RequestURI = string(v)
+		case protoUserField:
+			got.User = &User{}
+			a.consumeProtoFields(v, func(num protowire.Number, v []byte, _ uint64) {
+				switch num {
+				case protoUserNameField:
+					got.User.Name = string(v)
+				case protoUserGroupField:
+					got.User.Group = append(got.User.Group, string(v))
+				case protoUserExtraField:
+					if got.User.Extra == nil {
+						got.User.Extra = map[string][]string{}
+					}
+					a.consumeProtoMapEntry(v, got.User.Extra)
+				case protoUserRequestUserField:
+					got.User.RequestUser = string(v)
+				case protoUserRequestGroupsField:
+					got.User.RequestGroups = append(got.User.RequestGroups, string(v))
+				case protoUserAuthTokenField:
+					got.User.AuthToken = string(v)
+				case protoUserUIDField:
+					got.User.UID = string(v)
+				}
+			})
+		case protoMethodField:
+			got.Method = string(v)
+		case protoRemoteAddrField:
+			got.RemoteAddr = string(v)
+		case protoRequestTimestampField:
+			got.RequestTimestamp = string(v)
+		case protoResponseTimestampField:
+			got.ResponseTimestamp = string(v)
+		case protoResponseCodeField:
+			got.ResponseCode = int(varint)
+		case protoRequestHeaderField:
+			if got.RequestHeader == nil {
+				got.RequestHeader = http.Header{}
+			}
+			a.consumeProtoMapEntry(v, got.RequestHeader)
+		case protoResponseHeaderField:
+			if got.ResponseHeader == nil {
+				got.ResponseHeader = http.Header{}
+			}
+			a.consumeProtoMapEntry(v, got.ResponseHeader)
+		case protoRequestBodyField:
+			reqBody = v
+		case protoResponseBodyField:
+			resBody = v
+		case protoUserLoginNameField:
+			got.UserLoginName = string(v)
+		case protoNodeField:
+			got.Node = string(v)
+		case protoStageField:
+			got.Stage = string(v)
+		case protoDurationMillisField:
+			got.DurationMillis = int64(varint)
+		case protoSchemaVersionField:
+			got.SchemaVersion = string(v)
+		case protoRedactedKeysField:
+			got.RedactedKeys = append(got.RedactedKeys, string(v))
+		case protoRequestBodySHA256Field:
+			got.RequestBodySHA256 = string(v)
+		case protoResponseBodySHA256Field:
+			got.ResponseBodySHA256 = string(v)
+		case protoEventCountField:
+			got.EventCount = int(varint)
+		case protoResponseBodyRawField:
+			got.ResponseBodyRaw = v
+		case protoBodyOmittedReasonField:
+			got.BodyOmittedReason = string(v)
+		case protoRedactRulesField:
+			got.RedactRules = append(got.RedactRules, string(v))
+		case protoLabelsField:
+			if got.Labels == nil {
+				got.Labels = map[string]string{}
+			}
+			var key, value string
+			a.consumeProtoFields(v, func(num protowire.Number, v []byte, _ uint64) {
+				switch num {
+				case protoMapKeyField:
+					key = string(v)
+				case protoMapValueField:
+					value = string(v)
+				}
+			})
+			got.Labels[key] = value
+		case protoSuppressedCountField:
+			got.SuppressedCount = int(varint)
+		case protoClusterIDField:
+			got.ClusterID = string(v)
+		case protoRedactStatsField:
+			got.RedactStats = &RedactStats{}
+			a.consumeProtoFields(v, func(num protowire.Number, v []byte, varint uint64) {
+				switch num {
+				case protoRedactStatsCountField:
+					got.RedactStats.Count = int(varint)
+				case protoRedactStatsKeysField:
+					got.RedactStats.Keys = append(got.RedactStats.Keys, string(v))
+				}
+			})
+		case protoNamespaceField:
+			got.Namespace = string(v)
+		case protoResourceField:
+			got.Resource = string(v)
+		case protoNameField:
+			got.Name = string(v)
+		case protoConnectionField:
+			got.Connection = &Connection{}
+			a.consumeProtoFields(v, func(num protowire.Number, v []byte, _ uint64) {
+				switch num {
+				case protoConnectionTLSVersionField:
+					got.Connection.TLSVersion = string(v)
+				case protoConnectionCipherSuiteField:
+					got.Connection.CipherSuite = string(v)
+				case protoConnectionClientCertSubjectField:
+					got.Connection.ClientCertSubject = string(v)
+				}
+			})
+		case protoMutatingField:
+			got.Mutating = protowire.DecodeBool(varint)
+		case protoUnredactedField:
+			got.Unredacted = protowire.DecodeBool(varint)
+		case protoSummaryField:
+			got.Summary = &Summary{}
+			a.consumeProtoFields(v, func(num protowire.Number, v []byte, varint uint64) {
+				switch num {
+				case protoSummaryAuditedField:
+					got.Summary.Audited = int(varint)
+				case protoSummaryDroppedField:
+					got.Summary.Dropped = int(varint)
+				case protoSummaryFirstRequestTimestampField:
+					got.Summary.FirstRequestTimestamp = string(v)
+				case protoSummaryLastRequestTimestampField:
+					got.Summary.LastRequestTimestamp = string(v)
+				}
+			})
+		case protoRejectReasonField:
+			got.RejectReason = string(v)
+		case protoPartField:
+			got.Part = int(varint)
+		case protoTotalPartsField:
+			got.TotalParts = int(varint)
+		case protoBodyChunkField:
+			got.BodyChunk = v
+		case protoQueryParamsField:
+			if got.QueryParams == nil {
+				got.QueryParams = map[string][]string{}
+			}
+			a.consumeProtoMapEntry(v, got.QueryParams)
+		case protoGRPCStatusField:
+			code := int(int32(varint))
+			got.GRPCStatus = &code
+		case protoHeadersTruncatedField:
+			got.HeadersTruncated = protowire.DecodeBool(varint)
+		case protoClientClosedField:
+			got.ClientClosed = protowire.DecodeBool(varint)
+		case protoAuthFailedField:
+			got.AuthFailed = protowire.DecodeBool(varint)
+		case protoForwardedForField:
+			got.ForwardedFor = append(got.ForwardedFor, string(v))
+		}
+	})
+	return got, reqBody, resBody
+}
+
+// consumeProtoMapEntry decodes a map<string, Values> entry into m.
+func (a *AuditTest) consumeProtoMapEntry(b []byte, m map[string][]string) {
+	var key string
+	var values []string
+	a.consumeProtoFields(b, func(num protowire.Number, v []byte, _ uint64) {
+		switch num {
+		case protoMapKeyField:
+			key = string(v)
+		case protoMapValueField:
+			a.consumeProtoFields(v, func(_ protowire.Number, v []byte, _ uint64) {
+				values = append(values, string(v))
+			})
+		}
+	})
+	m[key] = values
+}
+
+// consumeProtoFields calls fn for each length delimited or varint field in the protobuf message b.
+func (a *AuditTest) consumeProtoFields(b []byte, fn func(num protowire.Number, v []byte, varint uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		a.Require().GreaterOrEqualf(n, 0, "Failed to read tag: %v", protowire.ParseError(n))
+		b = b[n:]
+
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			a.Require().GreaterOrEqualf(n, 0, "Failed to read field %d: %v", num, protowire.ParseError(n))
+			b = b[n:]
+			fn(num, v, 0)
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			a.Require().GreaterOrEqualf(n, 0, "Failed to read field %d: %v", num, protowire.ParseError(n))
+			b = b[n:]
+			fn(num, nil, v)
+		default:
+			a.FailNowf("Unexpected wire type", "field %d has wire type %d", num, typ)
+		}
+	}
+}
+
 // addMeta adds expected log metadata to the expected log message.
 func (a *AuditTest) addMeta(log *log, reqHeader, respHeader http.Header, reqBody, respBody string) string {
 	data := map[string]interface{}{}
@@ -518,6 +2047,7 @@ func (a *AuditTest) addMeta(log *log, reqHeader, respHeader http.Header, reqBody
 	}
 
 	data["method"] = log.Method
+	data["mutating"] = log.Mutating
 	data["requestTimestamp"] = log.RequestTimestamp
 	data["auditID"] = log.AuditID
 	data["responseHeader"] = respHeader
@@ -525,6 +2055,12 @@ func (a *AuditTest) addMeta(log *log, reqHeader, respHeader http.Header, reqBody
 		data["requestHeader"] = reqHeader
 	}
 	data["responseTimestamp"] = log.ResponseTimestamp
+	if log.Node != "" {
+		data["node"] = log.Node
+	}
+	if log.BodyOmittedReason != "" {
+		data["bodyOmittedReason"] = log.BodyOmittedReason
+	}
 	retJSON, err := json.Marshal(data)
 	a.NoErrorf(err, "Failed to add json metadata for log message check: %v", err)
 	return string(retJSON)
@@ -4,11 +4,13 @@
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,8 +24,21 @@
 	errorDebounceTime = time.Second * 30
 )
 
+// NewAuditLogMiddleware returns a middleware auditing the requests to the handler it wraps, redacting the values of the
+// keys matching the default redaction regex, which holds the private fields of the node and cluster drivers, in
+// addition to the keys always considered sensitive. The regex can be replaced with the writer's SetRedactRegex. It
+// captures the user, request and response and writes the audit log once the handler returns. If auditWriter is nil,
+// requests are passed on unaudited.
 func NewAuditLogMiddleware(auditWriter *LogWriter) (func(http.Handler) http.Handler, error) {
 	sensitiveRegex, err := constructKeyRedactRegex()
+	if auditWriter == nil {
+		logrus.Info("Audit logging is disabled")
+	} else {
+		logrus.Infof("Audit logging at level %s", auditWriter.LevelString())
+		if len(auditWriter.UnredactedGroups) != 0 {
+			logrus.Warnf("Audit logging bodies without redaction for members of the groups %v", auditWriter.UnredactedGroups)
+		}
+	}
 	return func(next http.Handler) http.Handler {
 		return &auditHandler{
 			next:            next,
@@ -35,23 +50,38 @@ func NewAuditLogMiddleware(auditWriter *LogWriter) (func(http.Handler) http.Hand
 	}, err
 }
 
-// constructKeyRedactRegex builds a regex for matching non-public fields from management.DriverData as well as fields that end with [pP]assword or [tT]oken.
+// constructKeyRedactRegex builds a regex for matching non-public fields from management.DriverData as well as fields that end with [pP]assword or [tT]oken
+// or hold an Authorization header.
 func constructKeyRedactRegex() (*regexp.Regexp, error) {
-	s := strings.Builder{}
-	s.WriteRune('(')
+	var patterns []string
 	for _, v := range management.DriverData {
 		for key, value := range v {
 			if strings.HasPrefix(key, "public") || strings.HasPrefix(key, "optional") {
 				continue
 			}
-			for _, item := range value {
-				s.WriteString(item + "|")
-			}
+			patterns = append(patterns, value...)
 		}
 	}
-	s.WriteString(`[pP]assword|[tT]oken|[kK]ube[cC]onfig)`)
+	patterns = append(patterns, `[pP]assword`, `[tT]oken`, `[kK]ube[cC]onfig`, `[aA]uthorization`, `[bB]earer`)
 
-	return regexp.Compile(s.String())
+	return CompileRedactPatterns(patterns)
+}
+
+// CompileRedactPatterns combines patterns matching keys whose values are redacted into a single regex, such as to be
+// passed to SetRedactRegex, so that they can be maintained as a list. Each pattern is compiled on
+// its own first so that an invalid one is reported by itself.
+func CompileRedactPatterns(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, errors.New("no redaction patterns")
+	}
+	groups := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %d %q: %w", i, pattern, err)
+		}
+		groups[i] = "(?:" + pattern + ")"
+	}
+	return regexp.Compile(strings.Join(groups, "|"))
 }
 
 type auditHandler struct {
@@ -63,15 +93,14 @@ type auditHandler struct {
 }
 
 func (h auditHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	if h.auditWriter == nil {
+	if h.auditWriter == nil || h.auditWriter.isIgnored(req) {
 		h.next.ServeHTTP(rw, req)
 		return
 	}
 
-	user := getUserInfo(req)
+	user := getUserInfo(req, h.auditWriter.UserExtraKeys)
 
-	context := context.WithValue(req.Context(), userKey, user)
-	req = req.WithContext(context)
+	req = req.WithContext(WithUser(req.Context(), user))
 
 	auditLog, err := newAuditLog(h.auditWriter, req, h.sanitizingRegex)
 	if err != nil {
@@ -79,10 +108,72 @@ func (h auditHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Handlers writing a body without calling WriteHeader implicitly respond with 200.
 	wr := &wrapWriter{ResponseWriter: rw, auditWriter: h.auditWriter, statusCode: http.StatusOK}
+	if isUpgradeRequest(req) {
+		wr.onHijack = func(conn net.Conn) net.Conn {
+			return h.auditUpgrade(auditLog, user, req, wr.Header(), conn)
+		}
+	}
+	watch := isWatchRequest(req)
+	var started time.Time
+	if watch {
+		// Watches stream events until the connection is closed, so they are audited when started and again when
+		// the stream ends, without recording the response body.
+		wr.stream = true
+		started = h.auditWriter.now()
+		auditLog.log.Stage = stageResponseStarted
+		h.logWriteErr(auditLog.write(user, req.Header, nil, 0, nil))
+	}
 	h.next.ServeHTTP(wr, req)
 
-	err = auditLog.write(user, req.Header, wr.Header(), wr.statusCode, wr.buf.Bytes())
+	if wr.hijacked && wr.onHijack != nil {
+		// The connection was taken over by the handler, upgraded connections are audited when hijacked and closed.
+		// Other hijacked requests are still audited once the handler returns.
+		return
+	}
+
+	statusCode := wr.statusCode
+	select {
+	case <-req.Context().Done():
+		// The client closed the connection, as opposed to the request timing out, before the handler returned.
+		auditLog.log.ClientClosed = errors.Is(req.Context().Err(), context.Canceled)
+		if auditLog.log.ClientClosed && !wr.written {
+			// The request was aborted before any response was written, so the response code is unknown. Requests
+			// timing out are still responded to by the server.
+			statusCode = 0
+		}
+	default:
+	}
+	if watch {
+		auditLog.log.Stage = stageResponseComplete
+		auditLog.log.DurationMillis = h.auditWriter.now().Sub(started).Milliseconds()
+		auditLog.log.EventCount = wr.events
+	}
+
+	h.logWriteErr(auditLog.write(user, req.Header, wr.Header(), statusCode, wr.buf.Bytes()))
+}
+
+// auditUpgrade writes an audit log for a connection that was successfully upgraded, such as a websocket used by
+// kubectl exec or a shell, and returns conn wrapped so that another audit log is written with the duration of the
+// connection when it is closed.
+func (h auditHandler) auditUpgrade(auditLog *auditLog, user *User, req *http.Request, resHeaders http.Header, conn net.Conn) net.Conn {
+	upgraded := auditLog.writer.now()
+	auditLog.log.Stage = stageResponseStarted
+	h.logWriteErr(auditLog.write(user, req.Header, resHeaders, http.StatusSwitchingProtocols, nil))
+
+	return &closeNotifyConn{
+		Conn: conn,
+		onClose: func() {
+			auditLog.log.Stage = stageResponseComplete
+			auditLog.log.DurationMillis = auditLog.writer.now().Sub(upgraded).Milliseconds()
+			h.logWriteErr(auditLog.write(user, req.Header, resHeaders, http.StatusSwitchingProtocols, nil))
+		},
+	}
+}
+
+// logWriteErr logs an error returned when writing an audit log, if any.
+func (h auditHandler) logWriteErr(err error) {
 	if err == nil {
 		return
 	}
@@ -94,10 +185,43 @@ func (h auditHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	// Only log duplicate error messages at most every errorDebounceTime.
 	// This is to prevent the rancher logs from being flooded with error messages
 	// when the log path is invalid or any other error that will always cause a write to fail.
-	if lastSeen, ok := h.errMap[err.Error()]; !ok || time.Since(lastSeen) > errorDebounceTime {
+	now := h.auditWriter.now()
+	if lastSeen, ok := h.errMap[err.Error()]; !ok || now.Sub(lastSeen) > errorDebounceTime {
 		logrus.Warnf("Failed to write audit log: %s", err)
-		h.errMap[err.Error()] = time.Now()
+		h.errMap[err.Error()] = now
+	}
+}
+
+// isUpgradeRequest reports whether the request asks to upgrade the connection to another protocol, such as websockets.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		if strings.Contains(strings.ToLower(v), "upgrade") {
+			return true
+		}
 	}
+	return false
+}
+
+// isWatchRequest reports whether the request watches for changes, as the response is then a stream of events.
+func isWatchRequest(req *http.Request) bool {
+	watch, err := strconv.ParseBool(req.URL.Query().Get("watch"))
+	return err == nil && watch
+}
+
+// closeNotifyConn calls onClose the first time the connection is closed.
+type closeNotifyConn struct {
+	net.Conn
+	once    sync.Once
+	onClose func()
+}
+
+func (c *closeNotifyConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.onClose)
+	return err
 }
 
 type wrapWriter struct {
@@ -105,21 +229,70 @@ type wrapWriter struct {
 	auditWriter *LogWriter
 	statusCode  int
 	buf         bytes.Buffer
+	// written is set once the handler starts writing the response.
+	written bool
+	// warnedWriteHeader is set once a superfluous WriteHeader call was warned about, later ones are only debugged.
+	warnedWriteHeader bool
+	hijacked          bool
+	// stream is set for responses that are streamed, such as watches, whose events are counted instead of buffered.
+	stream bool
+	// countEvents is set once the stream is known to be JSON, whose events are each terminated by a newline. Events
+	// of other streams, such as length-prefixed protobuf ones, are not counted.
+	countEvents   bool
+	streamChecked bool
+	events        int
+	// onHijack is called with the connection after it was successfully hijacked, the returned connection is given to the handler.
+	onHijack func(net.Conn) net.Conn
 }
 
+// WriteHeader records the first response code written. Informational responses, such as 103 Early Hints, may precede
+// it. Later calls are ignored, as the response code was already sent, and warned about once per request.
 func (aw *wrapWriter) WriteHeader(statusCode int) {
+	if aw.written {
+		if aw.warnedWriteHeader {
+			logrus.Debugf("Ignoring superfluous WriteHeader(%d) after the response code %d was written", statusCode, aw.statusCode)
+			return
+		}
+		aw.warnedWriteHeader = true
+		logrus.Warnf("Ignoring superfluous WriteHeader(%d) after the response code %d was written", statusCode, aw.statusCode)
+		return
+	}
 	aw.ResponseWriter.WriteHeader(statusCode)
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		return
+	}
 	aw.statusCode = statusCode
+	aw.written = true
 }
 
 func (aw *wrapWriter) Write(body []byte) (int, error) {
-	aw.buf.Write(body)
+	aw.written = true
+	if aw.stream {
+		if !aw.streamChecked {
+			aw.streamChecked = true
+			aw.countEvents = isJSONContentType(aw.Header().Get("Content-Type"))
+		}
+		if aw.countEvents {
+			// Newlines only end events, so events split across or merged into writes are still counted once.
+			aw.events += bytes.Count(body, []byte("\n"))
+		}
+	} else {
+		aw.buf.Write(body)
+	}
 	return aw.ResponseWriter.Write(body)
 }
 
 func (aw *wrapWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if hijacker, ok := aw.ResponseWriter.(http.Hijacker); ok {
-		return hijacker.Hijack()
+		conn, rw, err := hijacker.Hijack()
+		if err != nil {
+			return conn, rw, err
+		}
+		aw.hijacked = true
+		if aw.onHijack != nil {
+			conn = aw.onHijack(conn)
+		}
+		return conn, rw, nil
 	}
 	return nil, nil, fmt.Errorf("Upstream ResponseWriter of type %v does not implement http.Hijacker", reflect.TypeOf(aw.ResponseWriter))
 }
@@ -2,31 +2,468 @@
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
 
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/apiserver/pkg/endpoints/request"
 )
 
+// Format is the encoding used for audit log records.
+type Format int
+
+const (
+	// FormatJSON writes each record as a line of JSON.
+	FormatJSON Format = iota
+	// FormatProtobuf writes each record as an AuditLog message, defined in audit.proto, prefixed with its varint encoded length.
+	FormatProtobuf
+)
+
+// headerLevels maps the values of the level header to the level they set, LevelNull meaning the request is not audited.
+var headerLevels = map[string]Level{
+	"none":     LevelNull,
+	"metadata": LevelMetadata,
+	"full":     LevelRequestResponse,
+}
+
+// nodeNameEnv is the environment variable used to override the node name recorded in each audit log.
+const nodeNameEnv = "AUDIT_LOG_NODE_NAME"
+
 type LogWriter struct {
+	// Level is the initial audit level. Use SetLevel to change it once the writer is in use.
+	Level Level
+	// level, once set, is the audit level set with SetLevel plus one, stored atomically so that it can be changed
+	// while requests are being audited. It is 0 until then, Level being used instead.
+	level atomic.Int32
+	// redactRegex and redactKeys, once set, replace the redaction regex of the middleware and RedactKeys, so that they
+	// can be changed while requests are being audited.
+	redactRegex atomic.Pointer[regexp.Regexp]
+	redactKeys  atomic.Pointer[map[string]struct{}]
+	Output      *lumberjack.Logger
+	// Format is the encoding used for records, FormatJSON by default.
+	Format Format
+	// Pretty writes JSON records indented over multiple lines instead of one line each, to be read while developing.
+	// Records can still be read one after the other with a json.Decoder.
+	Pretty bool
+	// Node is the name of the Rancher server replica that responded to the request.
+	Node string
+	// Labels are static labels, such as the environment or region of the Rancher server, added to each record under
+	// "labels" so that records aggregated from many servers remain attributable. They must not be changed once the
+	// writer is in use.
+	Labels map[string]string
+	// RedactKeys is a set of body keys whose values are always redacted, checked before the redaction regex.
+	// Keys are matched case-insensitively and must be stored in lower case. Use SetRedactKeys to change them once
+	// the writer is in use.
+	RedactKeys map[string]struct{}
+	// KeepKeys is a set of keys whose values are never redacted, even if they match the redaction regex, such as
+	// keys wrongly considered sensitive. Keys are matched exactly and RedactKeys takes precedence.
+	KeepKeys map[string]struct{}
+	// RedactFunc, if set, decides whether the values of the scalar fields of bodies are redacted, instead of their
+	// keys being matched against RedactKeys, KeepKeys and the redaction regex, for rules these cannot express. It is
+	// not called with values that are already redacted. Values are still redacted by the value-based checks, such as
+	// RedactBearerTokens.
+	RedactFunc func(key string, value interface{}) bool
+	// UnredactedGroups are the groups whose members' request and response bodies are recorded without redaction, such
+	// as for admins investigating an incident. It must only be set on writers whose output is restricted accordingly.
+	// Such records are marked as unredacted. Sensitive headers and the bodies of RedactResponseURIs are still left out.
+	UnredactedGroups []string
+	// UserExtraKeys is the list of keys of the extra attributes of users to record, such as the principal IDs set by
+	// Rancher's authentication. If nil, all extra attributes are recorded.
+	UserExtraKeys []string
+	// AllowedHeaders is the list of request and response headers to record. If empty, all headers are recorded.
+	// Sensitive headers are never recorded, unless MaskSensitiveHeaders is set.
+	AllowedHeaders []string
+	// MaskSensitiveHeaders records sensitive headers, such as Authorization or Cookie, with their values redacted
+	// instead of leaving them out, so that their presence is known. The scheme of Authorization headers is kept, such
+	// as in "Bearer [redacted]".
+	MaskSensitiveHeaders bool
+	// MaxHeaders is the maximum number of request headers, and of response headers, to record, in the order of their
+	// names. Logs with headers left out are marked with HeadersTruncated. If 0, all headers are recorded.
+	MaxHeaders int
+	// RedactQueryHeaders is the list of response headers holding URLs whose sensitive query parameters are redacted.
+	// If nil, defaultRedactQueryHeaders is used.
+	RedactQueryHeaders []string
+	// RecordQueryParams records the query parameters of requests under "queryParams", with the values of sensitive
+	// parameters redacted, so that records can be filtered by them. RequestURI is recorded as it is either way.
+	RecordQueryParams bool
+	// SchemaVersion adds the version of the structure of the audit log to each record, so that consumers can detect
+	// changes to it.
+	SchemaVersion bool
+	// ReadSampleRate is the fraction, between 0 and 1, of GET requests that are audited. Requests whose response status
+	// is in AlwaysLogStatusCodes are audited regardless. If 0, all requests are audited.
+	ReadSampleRate float64
+	// AlwaysLogStatusCodes are the response status codes of requests that are always audited, even when not selected
+	// by sampling. If nil, authentication and authorization failures as well as server errors are always audited.
+	AlwaysLogStatusCodes []int
+	// DropEmptyFields omits fields that hold no information, such as a user without any name or groups, instead of
+	// writing them as empty objects.
+	DropEmptyFields bool
+	// RedactSecretDataBase64 replaces each value of redacted secret data with a base64 encoded redaction marker, so
+	// that consumers decoding secret data do not fail.
+	RedactSecretDataBase64 bool
+	// RedactKeyValuePairs redacts the value of objects of the form {"key": "<name>", "value": "<value>"}, such as
+	// answers, if their name is sensitive.
+	RedactKeyValuePairs bool
+	// RedactNonStringValues also redacts the numbers and booleans of sensitive keys, such as a numeric PIN. They are
+	// otherwise recorded as they are, such as "tokenTTL": 3600, as only string values of sensitive keys are redacted,
+	// unless RedactFunc is set, which is called with them.
+	RedactNonStringValues bool
+	// RedactResponseURIs match the URIs of requests whose response body is always replaced as a whole, such as
+	// kubeconfig generation, in case redacting its fields would miss one.
+	RedactResponseURIs []*regexp.Regexp
+	// RedactBearerTokens redacts string values holding a bearer token, such as "Bearer <token>", whatever their key.
+	RedactBearerTokens bool
+	// MaxRedactDepth is the number of nested objects and arrays redaction recurses into, values nested deeper are
+	// replaced as a whole. If 0, 64 is used.
+	MaxRedactDepth int
+	// RedactValuePatterns match string values that are redacted whatever their key, such as private keys or access
+	// keys in unexpected fields. Setting them disables skipping the redaction of bodies without sensitive keys.
+	RedactValuePatterns []*regexp.Regexp
+	// Base64UploadKeys are the keys, matched case-insensitively, under which files are uploaded as base64 strings, such
+	// as certificates or kubeconfigs. Their values are redacted if they are valid base64 of at least
+	// Base64UploadMinSize bytes, so that uploaded credentials are not recorded while short values are kept.
+	Base64UploadKeys []string
+	// Base64UploadMinSize is the size of the values of Base64UploadKeys from which they are redacted. If 0, 64 is used.
+	Base64UploadMinSize int
+	// StripPaths are the paths of keys, such as {"metadata", "managedFields"}, removed from the request and response
+	// bodies because they are noisy and of no use to audit, unlike redacted keys whose values are only masked. Each
+	// path is a list of keys rather than a dot separated string, since keys such as annotations may contain dots. Paths
+	// apply to each item of the lists they go through, such as the items of list responses.
+	StripPaths [][]string
+	// RedactRules are named patterns matching keys whose values are redacted, in addition to the redaction regex.
+	RedactRules []RedactRule
+	// ReportRedactRules records the names of the redaction rules that matched a redacted key in each log, never the
+	// redacted values.
+	ReportRedactRules bool
+	// ReportRedactStats records in each log the number of values redacted from its bodies and the names of their keys,
+	// never the redacted values.
+	ReportRedactStats bool
+	// IgnoreURIs match the paths of requests, such as health checks and metrics, that are never audited. Ignored
+	// requests are passed on before any work is done to audit them.
+	IgnoreURIs []*regexp.Regexp
+	// AuditURIs, if set, match the paths of the only requests that are audited, such as those to secrets, tokens and
+	// roles. Other requests are ignored like those matching IgnoreURIs.
+	AuditURIs []*regexp.Regexp
+	// AuditPreflight audits OPTIONS requests, such as CORS preflight requests, at the metadata level whatever the
+	// level of the writer, so that preflight patterns can be reviewed. Their Origin and Access-Control-Request-*
+	// headers are recorded even if they are not in AllowedHeaders.
+	AuditPreflight bool
+	// Policy, if set, decides the level of each request instead of the writer's level, see LoadPolicy. The level set
+	// with LevelHeader takes precedence.
+	Policy *Policy
+	// LevelHeader is the name of a request header, such as X-Audit-Level, with which users in one of LevelHeaderGroups
+	// can set the level of their request to none, metadata or full, such as to exempt health probes from auditing.
+	// The header is ignored for other users so that it cannot be used to evade auditing.
+	LevelHeader       string
+	LevelHeaderGroups []string
+	// ShouldLog decides, once the response status code is known, whether a request with the given method is audited.
+	// If nil, all requests are audited.
+	ShouldLog func(method string, statusCode int) bool
+	// TrustedProxies are the networks of the proxies, such as load balancers, whose X-Forwarded-For and X-Real-IP
+	// headers are used to find the address of the client. The headers of other peers are ignored so that clients
+	// cannot spoof their address.
+	TrustedProxies []*net.IPNet
+	// RecordForwardedFor records the addresses listed in the X-Forwarded-For header of requests from trusted proxies.
+	RecordForwardedFor bool
+	// HashRemoteAddr records the salted SHA-256 digest of the client IP instead of the remote address, for deployments
+	// where client IPs must not be stored.
+	HashRemoteAddr bool
+	// RemoteAddrSalt is prepended to the client IP before it is hashed, so that digests cannot be reversed by hashing
+	// every IP.
+	RemoteAddrSalt []byte
+	// DedupWindow, if positive, is how long identical requests, with the same user, method, URI and response status,
+	// are not audited again after one is. The number of requests suppressed is recorded in the next log of the request
+	// once the window expires, it is lost if there is none.
+	DedupWindow time.Duration
+	dedupCache  dedupCache
+	// Clock returns the current time used for timestamps and durations in audit logs. If nil, time.Now is used.
+	Clock func() time.Time
+	// Transform, if set, is called with each encoded record, including its trailing newline in JSON, and returns the
+	// record to write instead, such as with fields renamed, added or removed. The record is not written if it fails.
+	Transform func(entry []byte) ([]byte, error)
+	// Router, if set, receives the records instead of Output, so that they can be written to different writers,
+	// such as stdout and stderr, depending on their response status code.
+	Router *StatusRouter
+	// HashBodies records the SHA-256 digests of the request and response bodies, computed before redaction, instead
+	// of the bodies themselves, so that payloads can be verified without being retained.
+	HashBodies bool
+	// MaxBodySize, if positive, makes JSON and form request bodies be captured as the handler reads them, up to
+	// MaxBodySize bytes, instead of being read in full before the handler is called, so that large bodies are not held
+	// in memory twice. Parts of bodies that the handler does not read are not captured. Truncated JSON bodies cannot be
+	// redacted so the log records an error instead, while truncated forms are recorded without their last fields.
+	// Compressed response bodies that decompress to more than MaxBodySize bytes are left out of the log.
+	MaxBodySize int
+	// CaptureFormBodies records URL-encoded form request bodies, such as login forms, as JSON objects whose field
+	// values are redacted like those of JSON bodies.
+	CaptureFormBodies bool
+	// RawResponseBodies records response bodies that are not JSON, such as plain text errors, as they are. They are
+	// not redacted as they cannot be parsed.
+	RawResponseBodies bool
+	// BodySizeThreshold, if positive, is the size in bytes above which the captured request and response bodies are
+	// both left out of the log, which then notes the reason, instead of being recorded.
+	BodySizeThreshold int
+	// BodyOnMutationFailure records bodies only for requests changing resources that failed with a client or server
+	// error, as attempted changes are of more interest than successful ones. Bodies of other requests are left out
+	// whatever the level.
+	BodyOnMutationFailure bool
+	// Sinks, if set, receive the records instead of Output and Router, each with the bodies allowed by its level.
+	// What is captured is determined by the highest level of the writer and its sinks.
+	Sinks []Sink
+	// DegradeQueueDepth, if positive, is the number of records waiting to be written to Output or Sinks from which
+	// new records are downgraded to metadata, noting the reason, until slow outputs catch up. This keeps auditing from
+	// slowing down requests further when an output stalls.
+	DegradeQueueDepth int
+	// MaxRecordSize, if positive, is the size in bytes above which records with bodies are split into parts sharing
+	// their audit ID, for receivers rejecting larger records. The first part is the record without its bodies, and
+	// each following part carries a chunk of the bodies, see log.BodyChunk. Records without bodies are never split.
+	// The size is that of the records before any Transform.
+	MaxRecordSize int
+	// MaxEntryBytes, if positive, is the size in bytes above which records are not written as they are, for log
+	// pipelines with a maximum line length. It applies to the parts of split records, and to the records after any
+	// Transform. Oversized records are replaced by a record holding only the audit ID, method, user name, response
+	// code and timestamps, or dropped if DropOversizedEntries is set. They are counted either way, see
+	// OversizedEntries.
+	MaxEntryBytes int
+	// DropOversizedEntries drops records larger than MaxEntryBytes instead of replacing them.
+	DropOversizedEntries bool
+	// Fallback, if set, receives the records that could not be written to Output, the Router or a sink, such as
+	// os.Stderr or a file on another disk, so that they are not lost while the output is failing. The failure is then
+	// only counted, see WriteFailures, unless writing to Fallback fails too, see FallbackFailures.
+	Fallback io.Writer
+	// mu serializes writes to Output and Sinks so that records written concurrently are never interleaved, even if
+	// the writers are not safe for concurrent use.
+	mu sync.Mutex
+	// queueDepth is the number of records being written or waiting for mu to be written.
+	queueDepth atomic.Int64
+	// oversizedEntries is the number of records larger than MaxEntryBytes.
+	oversizedEntries atomic.Int64
+	// writeFailures and fallbackFailures are the number of records that could not be written to their output, and of
+	// those that could not be written to Fallback either.
+	writeFailures    atomic.Int64
+	fallbackFailures atomic.Int64
+	// summaryMu guards the counts of the audited requests reported by WriteSummary.
+	summaryMu    sync.Mutex
+	audited      int
+	dropped      int
+	firstRequest time.Time
+	lastRequest  time.Time
+}
+
+// RedactRule is a named pattern matching keys whose values are redacted.
+type RedactRule struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// Sink is an output receiving audit log records at its own level.
+type Sink struct {
+	Output io.Writer
 	Level  Level
-	Output *lumberjack.Logger
 }
 
+// StatusRouter writes audit log records to different writers based on the class of their response status code.
+type StatusRouter struct {
+	// Default receives the records of status classes without a writer in Classes.
+	Default io.Writer
+	// Classes maps a status class, such as 5 for server errors, to the writer receiving the records of that class.
+	Classes map[int]io.Writer
+	// mu serializes writes so that records are written to each writer in order and never interleaved.
+	mu sync.Mutex
+}
+
+// write writes the encoded record to the writer of the class of the status code.
+func (r *StatusRouter) write(statusCode int, entry []byte) error {
+	w, ok := r.Classes[statusCode/100]
+	if !ok {
+		w = r.Default
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return writeEntry(w, entry)
+}
+
+// writeEntry writes the encoded record to w while holding the writer's lock.
+func (l *LogWriter) writeEntry(w io.Writer, entry []byte) error {
+	l.queueDepth.Add(1)
+	defer l.queueDepth.Add(-1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writeFallback(entry, writeEntry(w, entry))
+}
+
+// writeFallback writes the encoded record to Fallback if writing it to its output failed with err, returning the
+// error only if Fallback is not set or failed too.
+func (l *LogWriter) writeFallback(entry []byte, err error) error {
+	if err == nil {
+		return nil
+	}
+	l.writeFailures.Add(1)
+	if l.Fallback == nil {
+		return err
+	}
+	if fallbackErr := writeEntry(l.Fallback, entry); fallbackErr != nil {
+		l.fallbackFailures.Add(1)
+		return errors.Join(err, fmt.Errorf("failed to write to fallback: %w", fallbackErr))
+	}
+	return nil
+}
+
+// WriteFailures returns the number of records that could not be written to Output, the Router or a sink, whether or
+// not they were written to Fallback, such as to be reported as a counter.
+func (l *LogWriter) WriteFailures() int {
+	return int(l.writeFailures.Load())
+}
+
+// FallbackFailures returns the number of records that could not be written to their output nor to Fallback, and were
+// lost, such as to be reported as a counter.
+func (l *LogWriter) FallbackFailures() int {
+	return int(l.fallbackFailures.Load())
+}
+
+// QueueDepth returns the number of records being written or waiting to be written to Output or Sinks, such as to be
+// reported as a gauge. It grows when outputs are slower than requests are audited.
+func (l *LogWriter) QueueDepth() int {
+	return int(l.queueDepth.Load())
+}
+
+// OversizedEntries returns the number of records that were larger than MaxEntryBytes and were dropped or replaced,
+// such as to be reported as a counter.
+func (l *LogWriter) OversizedEntries() int {
+	return int(l.oversizedEntries.Load())
+}
+
+// isBackedUp reports whether the queue of records to write is deep enough for new ones to be downgraded.
+func (l *LogWriter) isBackedUp() bool {
+	return l.DegradeQueueDepth > 0 && l.QueueDepth() >= l.DegradeQueueDepth
+}
+
+// LogFailedReads is a ShouldLog predicate auditing all write requests, but only GET requests that failed.
+func LogFailedReads(method string, statusCode int) bool {
+	return method != http.MethodGet || statusCode >= http.StatusBadRequest
+}
+
+// Start writes a summary of the audited requests, see WriteSummary, and closes Output once ctx is done.
 func (l *LogWriter) Start(ctx context.Context) {
 	if l == nil {
 		return
 	}
 	go func() {
 		<-ctx.Done()
-		l.Output.Close()
+		if err := l.WriteSummary(); err != nil {
+			logrus.Warnf("Failed to write audit log summary: %v", err)
+		}
+		if l.Output != nil {
+			l.Output.Close()
+		}
+	}()
+}
+
+// countAudited counts an audited request, requested at the RFC 3339 timestamp, for the summary, see WriteSummary.
+func (l *LogWriter) countAudited(requestTimestamp string, dropped bool) {
+	ts, err := time.Parse(time.RFC3339, requestTimestamp)
+
+	l.summaryMu.Lock()
+	defer l.summaryMu.Unlock()
+	l.audited++
+	if dropped {
+		l.dropped++
+	}
+	if err != nil {
+		return
+	}
+	if l.firstRequest.IsZero() || ts.Before(l.firstRequest) {
+		l.firstRequest = ts
+	}
+	if ts.After(l.lastRequest) {
+		l.lastRequest = ts
+	}
+}
+
+// summary returns the counts of the requests audited so far.
+func (l *LogWriter) summary() *Summary {
+	l.summaryMu.Lock()
+	defer l.summaryMu.Unlock()
+	summary := &Summary{Audited: l.audited, Dropped: l.dropped}
+	if l.audited != 0 && !l.firstRequest.IsZero() {
+		summary.FirstRequestTimestamp = l.firstRequest.Format(time.RFC3339)
+		summary.LastRequestTimestamp = l.lastRequest.Format(time.RFC3339)
+	}
+	return summary
+}
+
+// Reopen closes the output file so that the next record reopens it at its path, such as after external tooling
+// moved it away to rotate it. Records are not buffered, so all those written before are in the moved file.
+func (l *LogWriter) Reopen() error {
+	if l == nil || l.Output == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.Output.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log output %s: %w", l.Output.Filename, err)
+	}
+	return nil
+}
+
+// ReopenOnSignal reopens the output each time the process receives one of the signals, SIGHUP if none is given,
+// until the context is done. It is meant to be installed by callers whose audit log is rotated by external tooling.
+func (l *LogWriter) ReopenOnSignal(ctx context.Context, sigs ...os.Signal) {
+	if l == nil || l.Output == nil {
+		return
+	}
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, sigs...)
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ch:
+				if err := l.Reopen(); err != nil {
+					logrus.Warnf("Failed to reopen audit log: %v", err)
+				}
+			}
+		}
 	}()
 }
 
+// Probe checks that the output can be written to by opening it for appending without writing any data, so that a
+// misconfigured audit log path is reported at startup instead of on every request.
+func (l *LogWriter) Probe() error {
+	if l == nil || l.Output == nil {
+		return nil
+	}
+	if _, err := l.Output.Write(nil); err != nil {
+		return fmt.Errorf("audit log output %s is not writable: %w", l.Output.Filename, err)
+	}
+	return nil
+}
+
 func NewLogWriter(path string, level Level, maxAge, maxBackup, maxSize int) *LogWriter {
 	if path == "" || level == LevelNull {
 		return nil
 	}
 
-	return &LogWriter{
+	writer := &LogWriter{
 		Level: level,
 		Output: &lumberjack.Logger{
 			Filename:   path,
@@ -34,5 +471,232 @@ func NewLogWriter(path string, level Level, maxAge, maxBackup, maxSize int) *Log
 			MaxBackups: maxBackup,
 			MaxSize:    maxSize,
 		},
+		Node: nodeName(),
+	}
+	writer.SetLevel(level)
+
+	return writer
+}
+
+// alwaysLog reports whether requests with the given response status code must be audited regardless of sampling.
+func (l *LogWriter) alwaysLog(statusCode int) bool {
+	if l.AlwaysLogStatusCodes == nil {
+		return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden || statusCode >= http.StatusInternalServerError
+	}
+	return slices.Contains(l.AlwaysLogStatusCodes, statusCode)
+}
+
+// clientAddr returns the address of the client of the request and the addresses it was forwarded for. If the request
+// was sent by a trusted proxy, the client is the leftmost address of X-Forwarded-For, or X-Real-IP, instead of the proxy.
+func (l *LogWriter) clientAddr(req *http.Request) (string, []string) {
+	if len(l.TrustedProxies) == 0 || !l.isTrustedProxy(req.RemoteAddr) {
+		return req.RemoteAddr, nil
+	}
+
+	var forwardedFor []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				forwardedFor = append(forwardedFor, addr)
+			}
+		}
+	}
+	if len(forwardedFor) != 0 {
+		return forwardedFor[0], forwardedFor
+	}
+	if realIP := strings.TrimSpace(req.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP, nil
+	}
+	return req.RemoteAddr, nil
+}
+
+// isTrustedProxy reports whether the IP of the remote address is in one of the writer's trusted proxy networks.
+func (l *LogWriter) isTrustedProxy(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	return slices.ContainsFunc(l.TrustedProxies, func(network *net.IPNet) bool {
+		return network.Contains(ip)
+	})
+}
+
+// remoteAddr returns the remote address to record, hashed if the writer is configured to.
+func (l *LogWriter) remoteAddr(addr string) string {
+	if !l.HashRemoteAddr || addr == "" {
+		return addr
+	}
+	return hashRemoteAddr(addr, l.RemoteAddrSalt)
+}
+
+// isIgnored reports whether the request matches one of the writer's ignored URIs, or none of its audited URIs.
+func (l *LogWriter) isIgnored(req *http.Request) bool {
+	matches := func(uri *regexp.Regexp) bool {
+		return uri.MatchString(req.URL.Path)
+	}
+	if len(l.AuditURIs) != 0 && !slices.ContainsFunc(l.AuditURIs, matches) {
+		return true
+	}
+	return slices.ContainsFunc(l.IgnoreURIs, matches)
+}
+
+// requestLevel returns the level set with the writer's level header, and whether it was set by a user in one of the
+// groups allowed to.
+func (l *LogWriter) requestLevel(req *http.Request) (Level, bool) {
+	if l.LevelHeader == "" || len(l.LevelHeaderGroups) == 0 {
+		return LevelNull, false
+	}
+	level, ok := headerLevels[strings.ToLower(req.Header.Get(l.LevelHeader))]
+	if !ok {
+		return LevelNull, false
+	}
+	user, ok := request.UserFrom(req.Context())
+	if !ok || !slices.ContainsFunc(user.GetGroups(), func(group string) bool {
+		return slices.Contains(l.LevelHeaderGroups, group)
+	}) {
+		return LevelNull, false
+	}
+	return level, true
+}
+
+// dedupKey identifies identical requests.
+type dedupKey struct {
+	user, method, uri string
+	statusCode        int
+}
+
+// dedupEntry tracks the last audited of identical requests.
+type dedupEntry struct {
+	written    time.Time
+	suppressed int
+}
+
+// dedupCache holds the identical requests audited within the dedup window.
+type dedupCache struct {
+	mu        sync.Mutex
+	entries   map[dedupKey]*dedupEntry
+	lastSweep time.Time
+}
+
+// isDuplicate reports whether the request identified by key was audited within the dedup window and must be suppressed.
+// Otherwise, it returns the number of identical requests suppressed since it last was.
+func (l *LogWriter) isDuplicate(key dedupKey) (bool, int) {
+	now := l.now()
+	c := &l.dedupCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[key]; ok && now.Sub(entry.written) < l.DedupWindow {
+		entry.suppressed++
+		return true, 0
+	}
+
+	if c.entries == nil {
+		c.entries = make(map[dedupKey]*dedupEntry)
+	}
+	if now.Sub(c.lastSweep) >= l.DedupWindow {
+		// Drop expired entries so that the cache only holds requests of the last window.
+		for k, entry := range c.entries {
+			if k != key && now.Sub(entry.written) >= l.DedupWindow {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	var suppressed int
+	if entry, ok := c.entries[key]; ok {
+		suppressed = entry.suppressed
+	}
+	c.entries[key] = &dedupEntry{written: now}
+	return false, suppressed
+}
+
+// now returns the current time according to the writer's clock.
+func (l *LogWriter) now() time.Time {
+	if l.Clock == nil {
+		return time.Now()
+	}
+	return l.Clock()
+}
+
+// captureLevel returns the level determining what is captured for each request, which is the highest level of the
+// writer and its sinks.
+func (l *LogWriter) captureLevel() Level {
+	level := l.GetLevel()
+	for _, sink := range l.Sinks {
+		level = max(level, sink.Level)
+	}
+	return level
+}
+
+// GetLevel returns the current audit level, Level until it is changed with SetLevel.
+func (l *LogWriter) GetLevel() Level {
+	if level := l.level.Load(); level != 0 {
+		return Level(level - 1)
+	}
+	return l.Level
+}
+
+// isUnredactedUser reports whether the user is in one of the writer's unredacted groups.
+func (l *LogWriter) isUnredactedUser(user *User) bool {
+	if len(l.UnredactedGroups) == 0 || user == nil {
+		return false
+	}
+	return slices.ContainsFunc(user.Group, func(group string) bool {
+		return slices.Contains(l.UnredactedGroups, group)
+	})
+}
+
+// LevelString returns the name of the writer's current level, "Null" if the writer is nil as nothing is audited.
+func (l *LogWriter) LevelString() string {
+	if l == nil {
+		return LevelNull.String()
+	}
+	return l.GetLevel().String()
+}
+
+// SetLevel changes the audit level used for subsequent requests without restarting the writer.
+func (l *LogWriter) SetLevel(level Level) {
+	l.level.Store(int32(level) + 1)
+}
+
+// SetRedactRegex changes the regex matching the keys whose values are redacted for subsequent requests, replacing the
+// regex the middleware was created with.
+func (l *LogWriter) SetRedactRegex(regex *regexp.Regexp) {
+	l.redactRegex.Store(regex)
+}
+
+// SetRedactKeys replaces RedactKeys for subsequent requests without restarting the writer.
+func (l *LogWriter) SetRedactKeys(keys []string) {
+	set := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		set[strings.ToLower(key)] = struct{}{}
+	}
+	l.redactKeys.Store(&set)
+}
+
+// getRedactKeys returns the set of keys whose values are always redacted.
+func (l *LogWriter) getRedactKeys() map[string]struct{} {
+	if keys := l.redactKeys.Load(); keys != nil {
+		return *keys
+	}
+	return l.RedactKeys
+}
+
+// nodeName returns the name used to identify this Rancher server in audit logs,
+// preferring the value of nodeNameEnv and falling back to the hostname.
+func nodeName() string {
+	if name := os.Getenv(nodeNameEnv); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		logrus.Debugf("auditLog: failed to get hostname, node name will be omitted from audit logs: %v", err)
+		return ""
 	}
+	return name
 }
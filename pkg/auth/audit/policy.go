@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"sigs.k8s.io/yaml"
+)
+
+// policyLevels maps the levels of Kubernetes audit policies to audit levels.
+var policyLevels = map[auditv1.Level]Level{
+	auditv1.LevelNone:            LevelNull,
+	auditv1.LevelMetadata:        LevelMetadata,
+	auditv1.LevelRequest:         LevelRequest,
+	auditv1.LevelRequestResponse: LevelRequestResponse,
+}
+
+// Policy decides the level of each request with the rules of a Kubernetes audit policy, so that the requests to audit
+// can be described the same way as for the Kubernetes API server. As in Kubernetes, requests matching no rule are not
+// audited.
+//
+// Requests to the Kubernetes API, including those proxied to downstream clusters under /k8s/clusters/<cluster>, are
+// resource requests. All other requests, such as those to the Rancher API, are non-resource requests whose verb is
+// the lower case method.
+type Policy struct {
+	rules []auditv1.PolicyRule
+}
+
+// LoadPolicyFile reads the Kubernetes audit policy in the YAML file at path, see LoadPolicy.
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit policy: %w", err)
+	}
+	return LoadPolicy(data)
+}
+
+// LoadPolicy parses a Kubernetes audit policy in YAML. Features that do not apply to audit logs, such as omitted
+// stages, are ignored with a warning.
+func LoadPolicy(data []byte) (*Policy, error) {
+	var policy auditv1.Policy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("failed to parse audit policy: %w", err)
+	}
+
+	if len(policy.OmitStages) != 0 {
+		logrus.Warn("Ignoring omitStages of the audit policy, stages are not configurable")
+	}
+	if policy.OmitManagedFields {
+		logrus.Warn("Ignoring omitManagedFields of the audit policy, managed fields are always recorded")
+	}
+	for i, rule := range policy.Rules {
+		if _, ok := policyLevels[rule.Level]; !ok {
+			return nil, fmt.Errorf("audit policy rule %d has unknown level %q", i, rule.Level)
+		}
+		if len(rule.OmitStages) != 0 {
+			logrus.Warnf("Ignoring omitStages of audit policy rule %d, stages are not configurable", i)
+		}
+		if rule.OmitManagedFields != nil {
+			logrus.Warnf("Ignoring omitManagedFields of audit policy rule %d, managed fields are always recorded", i)
+		}
+	}
+
+	return &Policy{rules: policy.Rules}, nil
+}
+
+// level returns the level of the first rule matching the request, or LevelNull if none does.
+func (p *Policy) level(req *http.Request) Level {
+	attrs := newPolicyAttributes(req)
+	for i := range p.rules {
+		if attrs.matches(&p.rules[i]) {
+			return policyLevels[p.rules[i].Level]
+		}
+	}
+	return LevelNull
+}
+
+// policyAttributes are the attributes of a request matched by the rules of a policy.
+type policyAttributes struct {
+	userName   string
+	userGroups []string
+	verb       string
+	path       string
+	// resourceRequest is set for requests to resources of the Kubernetes API, resource is only set for them.
+	resourceRequest bool
+	resource        resourcePath
+}
+
+func newPolicyAttributes(req *http.Request) *policyAttributes {
+	attrs := &policyAttributes{
+		path: req.URL.Path,
+		verb: strings.ToLower(req.Method),
+	}
+	if user, ok := request.UserFrom(req.Context()); ok {
+		attrs.userName = user.GetName()
+		attrs.userGroups = user.GetGroups()
+	}
+
+	attrs.resource, attrs.resourceRequest = parseResourcePath(req.URL.Path)
+	if !attrs.resourceRequest {
+		return attrs
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		if watch, _ := strconv.ParseBool(req.URL.Query().Get("watch")); watch {
+			attrs.verb = "watch"
+		} else if attrs.resource.name == "" {
+			attrs.verb = "list"
+		} else {
+			attrs.verb = "get"
+		}
+	case http.MethodPost:
+		attrs.verb = "create"
+	case http.MethodPut:
+		attrs.verb = "update"
+	case http.MethodPatch:
+		attrs.verb = "patch"
+	case http.MethodDelete:
+		if attrs.resource.name == "" {
+			attrs.verb = "deletecollection"
+		} else {
+			attrs.verb = "delete"
+		}
+	}
+	return attrs
+}
+
+// matches reports whether the request matches the rule, following the semantics of Kubernetes audit policies.
+func (a *policyAttributes) matches(rule *auditv1.PolicyRule) bool {
+	if len(rule.Users) > 0 && !slices.Contains(rule.Users, a.userName) {
+		return false
+	}
+	if len(rule.UserGroups) > 0 && !slices.ContainsFunc(a.userGroups, func(group string) bool {
+		return slices.Contains(rule.UserGroups, group)
+	}) {
+		return false
+	}
+	if len(rule.Verbs) > 0 && !slices.Contains(rule.Verbs, a.verb) {
+		return false
+	}
+
+	if len(rule.Namespaces) > 0 || len(rule.Resources) > 0 {
+		return a.matchesResource(rule)
+	}
+	if len(rule.NonResourceURLs) > 0 {
+		return !a.resourceRequest && slices.ContainsFunc(rule.NonResourceURLs, func(spec string) bool {
+			return spec == "*" || spec == a.path || (strings.HasSuffix(spec, "*") && strings.HasPrefix(a.path, strings.TrimSuffix(spec, "*")))
+		})
+	}
+	return true
+}
+
+// matchesResource reports whether the request is for one of the namespaces and resources of the rule.
+func (a *policyAttributes) matchesResource(rule *auditv1.PolicyRule) bool {
+	if !a.resourceRequest {
+		return false
+	}
+	resource := a.resource
+	if len(rule.Namespaces) > 0 && !slices.Contains(rule.Namespaces, resource.namespace) {
+		return false
+	}
+	if len(rule.Resources) == 0 {
+		return true
+	}
+
+	combined := resource.resource
+	if resource.subresource != "" {
+		combined = resource.resource + "/" + resource.subresource
+	}
+	for _, gr := range rule.Resources {
+		if gr.Group != resource.apiGroup {
+			continue
+		}
+		if len(gr.Resources) == 0 {
+			return true
+		}
+		if len(gr.ResourceNames) > 0 && !slices.Contains(gr.ResourceNames, resource.name) {
+			continue
+		}
+		for _, res := range gr.Resources {
+			if res == combined || res == "*" ||
+				(resource.subresource != "" && strings.HasPrefix(res, "*/") && resource.subresource == strings.TrimPrefix(res, "*/")) ||
+				(strings.HasSuffix(res, "/*") && resource.resource == strings.TrimSuffix(res, "/*")) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package audit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+const testPolicy = `
+apiVersion: audit.k8s.io/v1
+kind: Policy
+omitStages:
+  - RequestReceived
+rules:
+  - level: None
+    nonResourceURLs:
+      - /healthz*
+      - /ping
+  - level: None
+    users: ["system:kube-proxy"]
+    verbs: ["watch"]
+    resources:
+      - group: ""
+        resources: ["endpoints", "services"]
+  - level: Metadata
+    resources:
+      - group: ""
+        resources: ["secrets", "configmaps", "pods/log"]
+  - level: Request
+    verbs: ["get", "list", "watch"]
+    resources:
+      - group: ""
+      - group: "apps"
+  - level: RequestResponse
+    namespaces: ["cattle-system"]
+  - level: RequestResponse
+    userGroups: ["admins"]
+    nonResourceURLs: ["/v3/*"]
+    omitManagedFields: true
+  - level: Metadata
+    nonResourceURLs: ["/v3/*"]
+`
+
+func (a *AuditTest) TestPolicy() {
+	policy, err := LoadPolicy([]byte(testPolicy))
+	a.Require().NoError(err)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   *user.DefaultInfo
+		want   Level
+	}{
+		{name: "ignored health check", method: http.MethodGet, target: "/healthz/ready", want: LevelNull},
+		{name: "ignored exact URL", method: http.MethodGet, target: "/ping", want: LevelNull},
+		{name: "ignored user and verb", method: http.MethodGet, target: "/api/v1/namespaces/default/services?watch=true", user: &user.DefaultInfo{Name: "system:kube-proxy"}, want: LevelNull},
+		{name: "other user of ignored verb", method: http.MethodGet, target: "/api/v1/namespaces/default/services?watch=true", want: LevelRequest},
+		{name: "secret in downstream cluster", method: http.MethodGet, target: "/k8s/clusters/c-abcde/api/v1/namespaces/default/secrets/my-secret", want: LevelMetadata},
+		{name: "subresource", method: http.MethodGet, target: "/api/v1/namespaces/default/pods/my-pod/log", want: LevelMetadata},
+		{name: "read of a group", method: http.MethodGet, target: "/apis/apps/v1/namespaces/default/deployments", want: LevelRequest},
+		{name: "write in a namespace", method: http.MethodPost, target: "/apis/apps/v1/namespaces/cattle-system/deployments", want: LevelRequestResponse},
+		{name: "write of a namespace", method: http.MethodDelete, target: "/api/v1/namespaces/cattle-system", want: LevelRequestResponse},
+		{name: "unmatched write", method: http.MethodPost, target: "/apis/apps/v1/namespaces/default/deployments", want: LevelNull},
+		{name: "Rancher API by user group", method: http.MethodPost, target: "/v3/users", user: &user.DefaultInfo{Name: "user-1", Groups: []string{"admins"}}, want: LevelRequestResponse},
+		{name: "Rancher API", method: http.MethodPost, target: "/v3/users", want: LevelMetadata},
+		{name: "unmatched non-resource URL", method: http.MethodGet, target: "/v1/management.cattle.io.clusters", want: LevelNull},
+	}
+	for _, tt := range tests {
+		a.Run(tt.name, func() {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.user == nil {
+				tt.user = &user.DefaultInfo{Name: "user-1", Groups: []string{"system:authenticated"}}
+			}
+			req = req.WithContext(request.WithUser(req.Context(), tt.user))
+			a.Equal(tt.want, policy.level(req))
+		})
+	}
+}
+
+func (a *AuditTest) TestPolicyLevels() {
+	policy, err := LoadPolicy([]byte(testPolicy))
+	a.Require().NoError(err)
+
+	handler, writer, tmpPath := a.newTestAuditHandler(LevelMetadata, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", contentTypeJSON)
+		_, err := rw.Write([]byte(`{"name":"deployment"}`))
+		a.Require().NoError(err)
+	}))
+	writer.Policy = policy
+
+	for _, target := range []string{"/healthz", "/apis/apps/v1/namespaces/cattle-system/deployments"} {
+		req := newTestRequest(http.MethodPost, target, strings.NewReader(`{"name":"deployment"}`))
+		req.Header.Set("Content-Type", contentTypeJSON)
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	logs := a.readLogs(tmpPath)
+	a.Require().Len(logs, 1, "Requests whose policy level is None should not be audited")
+	a.Equal("/apis/apps/v1/namespaces/cattle-system/deployments", logs[0]["requestURI"])
+	a.Equal(map[string]interface{}{"name": "deployment"}, logs[0]["requestBody"])
+	a.Equal(map[string]interface{}{"name": "deployment"}, logs[0]["responseBody"])
+}
+
+func (a *AuditTest) TestLoadPolicyErrors() {
+	_, err := LoadPolicy([]byte("rules: [}"))
+	a.Error(err)
+
+	_, err = LoadPolicy([]byte("rules:\n  - level: Everything\n"))
+	a.ErrorContains(err, "unknown level")
+}
@@ -0,0 +1,299 @@
+package audit
+
+import (
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Field numbers of the messages defined in audit.proto.
+const (
+	protoAuditIDField            protowire.Number = 1
+	protoRequestURIField         protowire.Number = 2
+	protoUserField               protowire.Number = 3
+	protoMethodField             protowire.Number = 4
+	protoRemoteAddrField         protowire.Number = 5
+	protoRequestTimestampField   protowire.Number = 6
+	protoResponseTimestampField  protowire.Number = 7
+	protoResponseCodeField       protowire.Number = 8
+	protoRequestHeaderField      protowire.Number = 9
+	protoResponseHeaderField     protowire.Number = 10
+	protoRequestBodyField        protowire.Number = 11
+	protoResponseBodyField       protowire.Number = 12
+	protoUserLoginNameField      protowire.Number = 13
+	protoNodeField               protowire.Number = 14
+	protoStageField              protowire.Number = 15
+	protoDurationMillisField     protowire.Number = 16
+	protoSchemaVersionField      protowire.Number = 17
+	protoRedactedKeysField       protowire.Number = 18
+	protoRequestBodySHA256Field  protowire.Number = 19
+	protoResponseBodySHA256Field protowire.Number = 20
+	protoEventCountField         protowire.Number = 21
+	protoResponseBodyRawField    protowire.Number = 22
+	protoBodyOmittedReasonField  protowire.Number = 23
+	protoRedactRulesField        protowire.Number = 24
+	protoLabelsField             protowire.Number = 25
+	protoForwardedForField       protowire.Number = 26
+	protoAuthFailedField         protowire.Number = 27
+	protoSuppressedCountField    protowire.Number = 28
+	protoClientClosedField       protowire.Number = 29
+	protoMutatingField           protowire.Number = 30
+	protoConnectionField         protowire.Number = 31
+	protoNamespaceField          protowire.Number = 32
+	protoResourceField           protowire.Number = 33
+	protoNameField               protowire.Number = 34
+	protoRedactStatsField        protowire.Number = 35
+	protoClusterIDField          protowire.Number = 36
+	protoHeadersTruncatedField   protowire.Number = 37
+	protoGRPCStatusField         protowire.Number = 38
+	protoQueryParamsField        protowire.Number = 39
+	protoPartField               protowire.Number = 40
+	protoTotalPartsField         protowire.Number = 41
+	protoBodyChunkField          protowire.Number = 42
+	protoRejectReasonField       protowire.Number = 43
+	protoUnredactedField         protowire.Number = 44
+	protoSummaryField            protowire.Number = 45
+
+	protoUserNameField          protowire.Number = 1
+	protoUserGroupField         protowire.Number = 2
+	protoUserExtraField         protowire.Number = 3
+	protoUserRequestUserField   protowire.Number = 4
+	protoUserRequestGroupsField protowire.Number = 5
+	protoUserAuthTokenField     protowire.Number = 6
+	protoUserUIDField           protowire.Number = 7
+
+	protoConnectionTLSVersionField        protowire.Number = 1
+	protoConnectionCipherSuiteField       protowire.Number = 2
+	protoConnectionClientCertSubjectField protowire.Number = 3
+
+	protoRedactStatsCountField protowire.Number = 1
+	protoRedactStatsKeysField  protowire.Number = 2
+
+	protoMapKeyField   protowire.Number = 1
+	protoMapValueField protowire.Number = 2
+
+	protoValuesField protowire.Number = 1
+
+	protoSummaryAuditedField               protowire.Number = 1
+	protoSummaryDroppedField               protowire.Number = 2
+	protoSummaryFirstRequestTimestampField protowire.Number = 3
+	protoSummaryLastRequestTimestampField  protowire.Number = 4
+)
+
+// formatProtobuf encodes the log message and the already redacted request and response bodies as an AuditLog
+// protobuf message prefixed with its varint encoded length.
+func formatProtobuf(log *log, reqBody, resBody []byte) ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, protoAuditIDField, string(log.AuditID))
+	b = appendProtoString(b, protoRequestURIField, log.RequestURI)
+	if log.User != nil {
+		b = protowire.AppendTag(b, protoUserField, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProtoUser(log.User))
+	}
+	b = appendProtoString(b, protoMethodField, log.Method)
+	b = appendProtoString(b, protoRemoteAddrField, log.RemoteAddr)
+	b = appendProtoString(b, protoRequestTimestampField, log.RequestTimestamp)
+	b = appendProtoString(b, protoResponseTimestampField, log.ResponseTimestamp)
+	if log.ResponseCode != 0 {
+		b = protowire.AppendTag(b, protoResponseCodeField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(log.ResponseCode))
+	}
+	b = appendProtoValuesMap(b, protoRequestHeaderField, log.RequestHeader)
+	b = appendProtoValuesMap(b, protoResponseHeaderField, log.ResponseHeader)
+	b = appendProtoBytes(b, protoRequestBodyField, reqBody)
+	b = appendProtoBytes(b, protoResponseBodyField, resBody)
+	b = appendProtoString(b, protoUserLoginNameField, log.UserLoginName)
+	b = appendProtoString(b, protoNodeField, log.Node)
+	b = appendProtoString(b, protoStageField, log.Stage)
+	b = appendProtoString(b, protoSchemaVersionField, log.SchemaVersion)
+	if log.DurationMillis != 0 {
+		b = protowire.AppendTag(b, protoDurationMillisField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(log.DurationMillis))
+	}
+	for _, key := range log.RedactedKeys {
+		b = protowire.AppendTag(b, protoRedactedKeysField, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+	}
+	b = appendProtoString(b, protoRequestBodySHA256Field, log.RequestBodySHA256)
+	b = appendProtoString(b, protoResponseBodySHA256Field, log.ResponseBodySHA256)
+	if log.EventCount != 0 {
+		b = protowire.AppendTag(b, protoEventCountField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(log.EventCount))
+	}
+	b = appendProtoBytes(b, protoResponseBodyRawField, log.ResponseBodyRaw)
+	b = appendProtoString(b, protoBodyOmittedReasonField, log.BodyOmittedReason)
+	for _, rule := range log.RedactRules {
+		b = protowire.AppendTag(b, protoRedactRulesField, protowire.BytesType)
+		b = protowire.AppendString(b, rule)
+	}
+	b = appendProtoStringMap(b, protoLabelsField, log.Labels)
+	if log.SuppressedCount != 0 {
+		b = protowire.AppendTag(b, protoSuppressedCountField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(log.SuppressedCount))
+	}
+	if log.Mutating {
+		b = protowire.AppendTag(b, protoMutatingField, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if log.ClientClosed {
+		b = protowire.AppendTag(b, protoClientClosedField, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	if log.AuthFailed {
+		b = protowire.AppendTag(b, protoAuthFailedField, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	for _, addr := range log.ForwardedFor {
+		b = protowire.AppendTag(b, protoForwardedForField, protowire.BytesType)
+		b = protowire.AppendString(b, addr)
+	}
+	if log.Connection != nil {
+		b = protowire.AppendTag(b, protoConnectionField, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProtoConnection(log.Connection))
+	}
+	b = appendProtoString(b, protoNamespaceField, log.Namespace)
+	b = appendProtoString(b, protoResourceField, log.Resource)
+	b = appendProtoString(b, protoNameField, log.Name)
+	b = appendProtoString(b, protoClusterIDField, log.ClusterID)
+	if log.RedactStats != nil {
+		b = protowire.AppendTag(b, protoRedactStatsField, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProtoRedactStats(log.RedactStats))
+	}
+	if log.HeadersTruncated {
+		b = protowire.AppendTag(b, protoHeadersTruncatedField, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+	b = appendProtoValuesMap(b, protoQueryParamsField, log.QueryParams)
+	if log.GRPCStatus != nil {
+		b = protowire.AppendTag(b, protoGRPCStatusField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(*log.GRPCStatus))
+	}
+	if log.Part != 0 {
+		b = protowire.AppendTag(b, protoPartField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(log.Part))
+		b = protowire.AppendTag(b, protoTotalPartsField, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(log.TotalParts))
+	}
+	b = appendProtoBytes(b, protoBodyChunkField, log.BodyChunk)
+	b = appendProtoString(b, protoRejectReasonField, log.RejectReason)
+	if log.Unredacted {
+		b = protowire.AppendTag(b, protoUnredactedField, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(true))
+	}
+
+	if log.Summary != nil {
+		b = protowire.AppendTag(b, protoSummaryField, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalProtoSummary(log.Summary))
+	}
+
+	return protowire.AppendBytes(nil, b), nil
+}
+
+func marshalProtoUser(user *User) []byte {
+	var b []byte
+	b = appendProtoString(b, protoUserNameField, user.Name)
+	for _, group := range user.Group {
+		b = protowire.AppendTag(b, protoUserGroupField, protowire.BytesType)
+		b = protowire.AppendString(b, group)
+	}
+	b = appendProtoValuesMap(b, protoUserExtraField, user.Extra)
+	b = appendProtoString(b, protoUserRequestUserField, user.RequestUser)
+	for _, group := range user.RequestGroups {
+		b = protowire.AppendTag(b, protoUserRequestGroupsField, protowire.BytesType)
+		b = protowire.AppendString(b, group)
+	}
+	b = appendProtoString(b, protoUserAuthTokenField, user.AuthToken)
+	b = appendProtoString(b, protoUserUIDField, user.UID)
+	return b
+}
+
+func marshalProtoConnection(conn *Connection) []byte {
+	var b []byte
+	b = appendProtoString(b, protoConnectionTLSVersionField, conn.TLSVersion)
+	b = appendProtoString(b, protoConnectionCipherSuiteField, conn.CipherSuite)
+	b = appendProtoString(b, protoConnectionClientCertSubjectField, conn.ClientCertSubject)
+	return b
+}
+
+func marshalProtoRedactStats(stats *RedactStats) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, protoRedactStatsCountField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(stats.Count))
+	for _, key := range stats.Keys {
+		b = protowire.AppendTag(b, protoRedactStatsKeysField, protowire.BytesType)
+		b = protowire.AppendString(b, key)
+	}
+	return b
+}
+
+func marshalProtoSummary(summary *Summary) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, protoSummaryAuditedField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(summary.Audited))
+	b = protowire.AppendTag(b, protoSummaryDroppedField, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(summary.Dropped))
+	b = appendProtoString(b, protoSummaryFirstRequestTimestampField, summary.FirstRequestTimestamp)
+	b = appendProtoString(b, protoSummaryLastRequestTimestampField, summary.LastRequestTimestamp)
+	return b
+}
+
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendProtoStringMap appends m as a map<string, string> field. Keys are sorted so the encoding is deterministic.
+func appendProtoStringMap(b []byte, num protowire.Number, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var entry []byte
+		entry = appendProtoString(entry, protoMapKeyField, k)
+		entry = appendProtoString(entry, protoMapValueField, m[k])
+
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
+
+// appendProtoValuesMap appends m as a map<string, Values> field. Keys are sorted so the encoding is deterministic.
+func appendProtoValuesMap(b []byte, num protowire.Number, m map[string][]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		var values []byte
+		for _, v := range m[k] {
+			values = protowire.AppendTag(values, protoValuesField, protowire.BytesType)
+			values = protowire.AppendString(values, v)
+		}
+
+		var entry []byte
+		entry = appendProtoString(entry, protoMapKeyField, k)
+		entry = protowire.AppendTag(entry, protoMapValueField, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, values)
+
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b
+}
@@ -6,10 +6,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/containers/image/v5/copy"
@@ -17,6 +27,7 @@
 	"github.com/containers/image/v5/transports/alltransports"
 	"github.com/containers/image/v5/types"
 	"github.com/creasty/defaults"
+	v3 "github.com/rancher/rancher/pkg/apis/management.cattle.io/v3"
 	provisioningv1api "github.com/rancher/rancher/pkg/apis/provisioning.cattle.io/v1"
 	v1 "github.com/rancher/rancher/pkg/apis/rke.cattle.io/v1"
 	"github.com/rancher/rancher/tests/v2prov/clients"
@@ -24,29 +35,83 @@
 	testdefaults "github.com/rancher/rancher/tests/v2prov/defaults"
 	"github.com/rancher/rancher/tests/v2prov/namespace"
 	"github.com/rancher/rancher/tests/v2prov/registry"
+	provwait "github.com/rancher/rancher/tests/v2prov/wait"
 	rancherClient "github.com/rancher/shepherd/clients/rancher"
 	management "github.com/rancher/shepherd/clients/rancher/generated/management/v3"
 	"github.com/rancher/shepherd/extensions/token"
 	"github.com/rancher/shepherd/pkg/config"
 	namegen "github.com/rancher/shepherd/pkg/namegenerator"
 	pkgpf "github.com/rancher/shepherd/pkg/portforward"
+	"github.com/rancher/wrangler/v3/pkg/condition"
 	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	kwait "k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/retry"
 )
 
 const (
-	clusterNameBaseName = "integration-test-cluster"
+	clusterNameBaseName  = "integration-test-cluster"
+	configEnvironmentKey = "CATTLE_TEST_CONFIG"
+	// setupConfigPathEnvironmentKey optionally overrides where the test config is written.
+	setupConfigPathEnvironmentKey = "SETUP_CONFIG_PATH"
+	// clusterCountEnvironmentKey optionally sets the number of test clusters to create.
+	clusterCountEnvironmentKey = "SETUP_CLUSTER_COUNT"
+	// clusterNamesConfigKey is the config key listing the names of all test clusters when more than one is created.
+	clusterNamesConfigKey = "clusterNames"
+	// tokenFileEnvironmentKey optionally sets the path to a file holding an existing admin token to use instead of
+	// generating one.
+	tokenFileEnvironmentKey = "SETUP_TOKEN_FILE"
+	// importKubeconfigEnvironmentKey optionally sets the path to the kubeconfig of an existing cluster to import as
+	// the test cluster instead of creating one.
+	importKubeconfigEnvironmentKey = "SETUP_IMPORT_KUBECONFIG"
+	// pollTimeoutEnvironmentKey optionally overrides how long to wait for Rancher to be ready and issue a token.
+	pollTimeoutEnvironmentKey = "SETUP_POLL_TIMEOUT"
+	// tokenTTLEnvironmentKey optionally sets how long the generated admin token is valid for. By default a token
+	// without a TTL is created, so that long-running suites are not interrupted by the login token expiring after
+	// Rancher's auth-user-session-ttl-minutes, 16 hours by default. Rancher's auth-token-max-ttl-minutes, if set, still
+	// caps the TTL of either.
+	tokenTTLEnvironmentKey = "SETUP_TOKEN_TTL"
+	// refreshTokenEnvironmentKey, if set, makes setup only replace the expiring admin token of an existing test config
+	// with a new one, logging in again with its adminCredentials.
+	refreshTokenEnvironmentKey = "SETUP_REFRESH_TOKEN"
+	// adminPasswordEnvironmentKey optionally sets the password to log in with when refreshing the admin token. The
+	// password is never written to the test config.
+	adminPasswordEnvironmentKey = "SETUP_ADMIN_PASSWORD"
+	// adminCredentialsConfigKey is the config key holding what is needed to log in again once an admin token with a
+	// TTL has expired.
+	adminCredentialsConfigKey = "adminCredentials"
+
+	adminUsername = "admin"
+	adminPassword = "admin"
+
+	pollInterval       = 500 * time.Millisecond
+	defaultPollTimeout = 5 * time.Minute
+	// pollJitterFactor is the maximum fraction of pollInterval added to each wait so retries don't hit a booting
+	// Rancher in lockstep.
+	pollJitterFactor = 0.5
 )
 
 // main creates a test namespace and cluster for use in integration tests.
 func main() {
+	if os.Getenv(refreshTokenEnvironmentKey) != "" {
+		if err := refreshConfigToken(); err != nil {
+			logrus.Fatalf("Error refreshing admin token: %v", err)
+		}
+		return
+	}
+
+	// An existing cluster is imported instead of creating new ones if its kubeconfig is provided.
+	importKubeconfig := os.Getenv(importKubeconfigEnvironmentKey)
+
 	// Make sure a valid cluster agent image tag was provided before doing anything else. The envvar CATTLE_AGENT_IMAGE
 	// should be the image name (and tag) assigned to the cattle cluster agent image that was just built during CI.
 	agentImage := os.Getenv("CATTLE_AGENT_IMAGE")
-	if agentImage == "" {
+	if agentImage == "" && importKubeconfig == "" {
 		logrus.Fatal("Envvar CATTLE_AGENT_IMAGE must be set to a valid rancher-agent Docker image")
 	}
 
@@ -57,31 +122,46 @@ func main() {
 	}
 
 	hostURL := fmt.Sprintf("%s:8443", ipAddress.String())
+	logrus.WithFields(logrus.Fields{"host": hostURL}).Infof("Using Rancher host %s", hostURL)
 
-	var userToken *management.Token
-
-	err = kwait.Poll(500*time.Millisecond, 5*time.Minute, func() (done bool, err error) {
-		userToken, err = token.GenerateUserToken(&management.User{
-			Username: "admin",
-			Password: "admin",
-		}, hostURL)
+	timeout, err := pollTimeout()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	adminToken, err := readTokenFile()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	var ttl time.Duration
+	if adminToken == "" {
+		ttl, err = tokenTTL()
 		if err != nil {
-			return false, nil
+			logrus.Fatal(err)
 		}
+		adminToken, err = generateAdminToken(hostURL, timeout, ttl)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
 
-		return true, nil
-	})
-
+	count, err := clusterCount()
 	if err != nil {
-		logrus.Fatalf("Error with generating admin token: %v", err)
+		logrus.Fatal(err)
+	}
+	if importKubeconfig != "" && count > 1 {
+		logrus.Fatalf("%s cannot be set with %s, a single cluster is imported", clusterCountEnvironmentKey, importKubeconfigEnvironmentKey)
+	}
+	clusterNames := make([]string, count)
+	for i := range clusterNames {
+		clusterNames[i] = namegen.AppendRandomString(clusterNameBaseName)
 	}
 
 	cleanup := true
 	rancherConfig := rancherClient.Config{
-		AdminToken:  userToken.Token,
+		AdminToken:  adminToken,
 		Host:        hostURL,
 		Cleanup:     &cleanup,
-		ClusterName: namegen.AppendRandomString(clusterNameBaseName),
+		ClusterName: clusterNames[0],
 	}
 
 	err = defaults.Set(&rancherConfig)
@@ -89,10 +169,27 @@ func main() {
 		logrus.Fatalf("Error with setting up config file: %v", err)
 	}
 
+	configPath, err := setupConfigPath()
+	if err != nil {
+		logrus.Fatalf("Error setting up test config path: %v", err)
+	}
+
 	err = config.WriteConfig(rancherClient.ConfigurationFileKey, &rancherConfig)
 	if err != nil {
-		logrus.Fatalf("Error writing test config: %v", err)
+		logrus.WithFields(logrus.Fields{"configPath": configPath}).Fatalf("Error writing test config: %v", err)
+	}
+	if count > 1 {
+		// The rancher config only holds a single cluster name, the others are listed under their own key.
+		config.UpdateConfig(clusterNamesConfigKey, clusterNames)
 	}
+	if ttl > 0 {
+		// The token expires, so callers need to know who to log in as to get a new one, see refreshConfigToken.
+		config.UpdateConfig(adminCredentialsConfigKey, adminCredentials{
+			Username: adminUsername,
+			TokenTTL: ttl.String(),
+		})
+	}
+	logrus.WithFields(logrus.Fields{"configPath": configPath, "host": hostURL}).Infof("Wrote test config for host %s to %s", hostURL, configPath)
 
 	// Note that we do not defer clusterClients.Close() here. This is because doing so would cause the test namespace
 	// in which the downstream cluster resides to be deleted before it can be used in tests.
@@ -107,6 +204,15 @@ func main() {
 		logrus.Fatalf("Error creating namespace: %v", err)
 	}
 
+	if importKubeconfig != "" {
+		// The imported cluster already runs, so no images need to be pushed to a registry for it.
+		if err := importCluster(clusterClients, clusterNames[0], ns.Name, importKubeconfig, timeout); err != nil {
+			logrus.Fatalf("Error importing integration test cluster: %v", err)
+		}
+		logrus.Infof("Test cluster %s imported successfully. Setup complete.", clusterNames[0])
+		return
+	}
+
 	logrus.Infof("Deploying registry to default namespace with secrets in namespace %s", ns.Name)
 	reg, err := registry.CreateOrGetRegistry(clusterClients, ns.Name, "registry", false)
 	if err != nil {
@@ -182,16 +288,318 @@ func main() {
 		logrus.Fatalf("Failed to push images to registry: %v", err)
 	}
 
+	// Create all clusters concurrently, each one waits for readiness independently.
+	var wg sync.WaitGroup
+	errs := make([]error, len(clusterNames))
+	for i, name := range clusterNames {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = createCluster(clusterClients, name, ns.Name, reg)
+		}(i, name)
+	}
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		logrus.Fatalf("Error creating integration test clusters: %v", err)
+	}
+
+	logrus.Infof("Test clusters %s created successfully. Setup complete.", strings.Join(clusterNames, ", "))
+}
+
+// readTokenFile returns the admin token read from the file set in SETUP_TOKEN_FILE, or an empty string if it is not set.
+func readTokenFile() (string, error) {
+	path := os.Getenv(tokenFileEnvironmentKey)
+	if path == "" {
+		return "", nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading admin token from %s: %w", path, err)
+	}
+	adminToken := strings.TrimSpace(string(data))
+	if adminToken == "" {
+		return "", fmt.Errorf("%s %s is empty, expected an admin token", tokenFileEnvironmentKey, path)
+	}
+
+	logrus.WithFields(logrus.Fields{"tokenFile": path}).Infof("Using admin token from %s", path)
+	return adminToken, nil
+}
+
+// adminCredentials are written to the test config when the admin token expires. The password is not, it is read from
+// SETUP_ADMIN_PASSWORD when refreshing the token.
+type adminCredentials struct {
+	Username string `json:"username" yaml:"username"`
+	TokenTTL string `json:"tokenTTL" yaml:"tokenTTL"`
+}
+
+// refreshConfigToken replaces the admin token of the test config with a new one with the same TTL, logging in again
+// with its adminCredentials.
+func refreshConfigToken() error {
+	if os.Getenv(configEnvironmentKey) == "" {
+		return fmt.Errorf("%s must be set to the test config to refresh", configEnvironmentKey)
+	}
+
+	var rancherConfig rancherClient.Config
+	config.LoadConfig(rancherClient.ConfigurationFileKey, &rancherConfig)
+	var creds adminCredentials
+	config.LoadConfig(adminCredentialsConfigKey, &creds)
+	if creds.Username == "" {
+		return fmt.Errorf("the test config has no %s, its admin token does not expire", adminCredentialsConfigKey)
+	}
+
+	password := os.Getenv(adminPasswordEnvironmentKey)
+	if password == "" {
+		password = adminPassword
+	}
+	adminToken, err := refreshAdminToken(rancherConfig.Host, creds, password)
+	if err != nil {
+		return err
+	}
+
+	rancherConfig.AdminToken = adminToken
+	config.UpdateConfig(rancherClient.ConfigurationFileKey, rancherConfig)
+	logrus.WithFields(logrus.Fields{"host": rancherConfig.Host}).Infof("Refreshed admin token valid for %s", creds.TokenTTL)
+	return nil
+}
+
+// refreshAdminToken logs in with the credentials and password and returns a new token valid for their TTL.
+func refreshAdminToken(hostURL string, creds adminCredentials, password string) (string, error) {
+	ttl, err := time.ParseDuration(creds.TokenTTL)
+	if err != nil || ttl <= 0 {
+		return "", fmt.Errorf("%s has an invalid tokenTTL %q", adminCredentialsConfigKey, creds.TokenTTL)
+	}
+
+	userToken, err := token.GenerateUserToken(&management.User{
+		Username: creds.Username,
+		Password: password,
+	}, hostURL)
+	if err != nil {
+		return "", fmt.Errorf("error logging in as %s: %w", creds.Username, err)
+	}
+	return createToken(hostURL, userToken.Token, ttl)
+}
+
+// generateAdminToken generates a token for the admin user once Rancher is ready, retrying until it succeeds or timeout
+// has elapsed since it was called, including the wait for Rancher. The token is created with the login token, which
+// expires with the session, and is valid for ttl, or does not expire if ttl is 0. Errors creating it which retrying
+// cannot fix, such as an invalid TTL, are returned without retrying.
+func generateAdminToken(hostURL string, timeout, ttl time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	// Rancher accepts connections before it serves its API, so wait for it to avoid confusing token errors.
+	if err := waitForReady(hostURL, timeout); err != nil {
+		return "", err
+	}
+
+	var adminToken string
+
+	tokenStart := time.Now()
+	// The wait for Rancher and token generation share the timeout, at least one attempt is still made.
+	attempt, err := pollWithJitter(pollInterval, time.Until(deadline), func(attempt int) (bool, error) {
+		userToken, err := token.GenerateUserToken(&management.User{
+			Username: adminUsername,
+			Password: adminPassword,
+		}, hostURL)
+		if err != nil {
+			return false, nil
+		}
+
+		adminToken, err = createToken(hostURL, userToken.Token, ttl)
+		var statusErr *tokenStatusError
+		if errors.As(err, &statusErr) && statusErr.permanent() {
+			return false, err
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"host": hostURL, "attempt": attempt}).Warnf("Failed to create admin token: %v", err)
+			return false, nil
+		}
+		return true, nil
+	})
+
+	tokenFields := logrus.Fields{
+		"host":       hostURL,
+		"attempt":    attempt,
+		"durationMs": time.Since(tokenStart).Milliseconds(),
+	}
+	if err != nil {
+		logrus.WithFields(tokenFields).Errorf("Failed to generate admin token: %v", err)
+		return "", fmt.Errorf("error with generating admin token: %w", err)
+	}
+	logrus.WithFields(tokenFields).Infof("Acquired admin token after %d attempts", attempt)
+
+	return adminToken, nil
+}
+
+// createToken creates an API token valid for ttl, or without expiry if ttl is 0, authenticating with bearerToken.
+func createToken(hostURL, bearerToken string, ttl time.Duration) (string, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"type":        "token",
+		"description": "integration test setup",
+		"ttl":         ttl.Milliseconds(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("https://%s/v3/tokens", hostURL), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+bearerToken)
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		// Rancher uses a self-signed certificate.
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error creating token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", &tokenStatusError{statusCode: resp.StatusCode, status: resp.Status}
+	}
+
+	var created struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("error decoding created token: %w", err)
+	}
+	if created.Token == "" {
+		return "", errors.New("error creating token: no token in response")
+	}
+	return created.Token, nil
+}
+
+// tokenStatusError is returned when Rancher responds to a token creation with an unexpected status.
+type tokenStatusError struct {
+	statusCode int
+	status     string
+}
+
+func (e *tokenStatusError) Error() string {
+	return fmt.Sprintf("error creating token: unexpected status %s", e.status)
+}
+
+// permanent reports whether the status is a client error that retrying the same request cannot fix.
+func (e *tokenStatusError) permanent() bool {
+	return e.statusCode >= 400 && e.statusCode < 500 && e.statusCode != http.StatusTooManyRequests
+}
+
+// waitForReady polls the /ping endpoint of the Rancher server with the same interval as token generation until it
+// responds successfully or timeout has elapsed.
+func waitForReady(hostURL string, timeout time.Duration) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		// Rancher uses a self-signed certificate.
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+
+	start := time.Now()
+	attempt, err := pollWithJitter(pollInterval, timeout, func(attempt int) (bool, error) {
+		resp, err := client.Get(fmt.Sprintf("https://%s/ping", hostURL))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return true, nil
+			}
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		if attempt == 1 {
+			logrus.WithFields(logrus.Fields{"host": hostURL}).Infof("Waiting for Rancher to be ready: %v", err)
+		}
+		return false, nil
+	})
+
+	fields := logrus.Fields{
+		"host":       hostURL,
+		"attempt":    attempt,
+		"durationMs": time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		logrus.WithFields(fields).Errorf("Rancher was not ready: %v", err)
+		return fmt.Errorf("error waiting for Rancher at %s to be ready: %w", hostURL, err)
+	}
+	logrus.WithFields(fields).Infof("Rancher is ready after %d attempts", attempt)
+	return nil
+}
+
+// sleep waits between polling attempts, it is replaced in tests.
+var sleep = time.Sleep
+
+// pollWithJitter calls condition until it returns true or an error, waiting interval plus up to pollJitterFactor of
+// random jitter between attempts. It gives up once timeout has elapsed or timeout/interval attempts have been made,
+// whichever comes first, and returns the number of attempts made.
+func pollWithJitter(interval, timeout time.Duration, condition func(attempt int) (bool, error)) (int, error) {
+	maxAttempts := int(timeout / interval)
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		done, err := condition(attempt)
+		if err != nil {
+			return attempt, err
+		}
+		if done {
+			return attempt, nil
+		}
+
+		elapsed := time.Since(start)
+		if attempt >= maxAttempts || elapsed >= timeout {
+			return attempt, fmt.Errorf("gave up after %d attempts over %s", attempt, elapsed.Round(time.Second))
+		}
+		sleep(kwait.Jitter(interval, pollJitterFactor))
+	}
+}
+
+// pollTimeout returns how long to poll Rancher for, read from SETUP_POLL_TIMEOUT and defaulting to five minutes.
+func pollTimeout() (time.Duration, error) {
+	value := os.Getenv(pollTimeoutEnvironmentKey)
+	if value == "" {
+		return defaultPollTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("%s must be a positive duration, got %q", pollTimeoutEnvironmentKey, value)
+	}
+	return timeout, nil
+}
+
+// tokenTTL returns how long the generated admin token is valid for, read from SETUP_TOKEN_TTL and defaulting to 0,
+// which creates a token without expiry.
+func tokenTTL() (time.Duration, error) {
+	value := os.Getenv(tokenTTLEnvironmentKey)
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration, got %q", tokenTTLEnvironmentKey, value)
+	}
+	return ttl, nil
+}
+
+// createCluster creates a downstream test cluster using the given registries and waits for it to be ready.
+func createCluster(clusterClients *clients.Clients, name, namespace string, reg v1.Registry) error {
 	logrus.Infof(
 		"Creating test cluster %s with %s in namespace %s",
-		rancherConfig.ClusterName,
+		name,
 		testdefaults.SomeK8sVersion,
-		ns.Name,
+		namespace,
 	)
 	c, err := cluster.New(clusterClients, &provisioningv1api.Cluster{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      rancherConfig.ClusterName,
-			Namespace: ns.Name,
+			Name:      name,
+			Namespace: namespace,
 		},
 		Spec: provisioningv1api.ClusterSpec{
 			KubernetesVersion: testdefaults.SomeK8sVersion,
@@ -209,16 +617,168 @@ func main() {
 		},
 	})
 	if err != nil {
-		logrus.Fatalf("Error creating integration test cluster: %v", err)
+		return fmt.Errorf("error creating integration test cluster %s: %w", name, err)
 	}
 
-	logrus.Info("Waiting for test cluster to be ready")
+	logrus.Infof("Waiting for test cluster %s to be ready", name)
 	c, err = cluster.WaitForCreate(clusterClients, c)
 	if err != nil {
-		logrus.Fatalf("Error waiting for test cluster to be ready: %v", err)
+		return fmt.Errorf("error waiting for test cluster %s to be ready: %w", name, err)
+	}
+
+	logrus.Infof("Test cluster %s created successfully", c.Name)
+	return nil
+}
+
+// importCluster registers the existing cluster of the given kubeconfig with Rancher as a test cluster and waits for it
+// to be ready, waiting up to timeout for its import command.
+func importCluster(clusterClients *clients.Clients, name, namespace, kubeconfigPath string, timeout time.Duration) error {
+	logrus.Infof("Importing the cluster of %s as test cluster %s in namespace %s", kubeconfigPath, name, namespace)
+	// Check the cluster can be reached first so that an unusable kubeconfig doesn't leave a cluster stuck pending.
+	if err := checkKubeconfig(kubeconfigPath); err != nil {
+		return err
+	}
+
+	c, err := clusterClients.Provisioning.Cluster().Create(importedCluster(name, namespace))
+	if err != nil {
+		return fmt.Errorf("error creating imported test cluster %s: %w", name, err)
+	}
+
+	err = provwait.Object(clusterClients.Ctx, clusterClients.Provisioning.Cluster().Watch, c, func(obj runtime.Object) (bool, error) {
+		c = obj.(*provisioningv1api.Cluster)
+		return c.Status.ClusterName != "", nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for management cluster of imported test cluster %s: %w", name, err)
+	}
+
+	command, err := importCommand(clusterClients, c.Status.ClusterName, timeout)
+	if err != nil {
+		return fmt.Errorf("error getting import command for test cluster %s: %w", name, err)
+	}
+
+	if output, err := importCmd(command, kubeconfigPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("error applying import manifest to the cluster of %s: %w: %s", kubeconfigPath, err, output)
+	}
+
+	logrus.Infof("Waiting for imported test cluster %s to be ready", name)
+	mgmtCluster, err := clusterClients.Mgmt.Cluster().Get(c.Status.ClusterName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting management cluster of imported test cluster %s: %w", name, err)
+	}
+	err = provwait.Object(clusterClients.Ctx, func(namespace string, opts metav1.ListOptions) (watch.Interface, error) {
+		return clusterClients.Mgmt.Cluster().Watch(opts)
+	}, mgmtCluster, func(obj runtime.Object) (bool, error) {
+		return condition.Cond("Ready").IsTrue(obj.(*v3.Cluster)), nil
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for imported test cluster %s to be ready: %w", name, err)
+	}
+
+	logrus.Infof("Test cluster %s imported successfully", name)
+	return nil
+}
+
+// importedCluster returns the provisioning cluster to create for an imported test cluster. It has no RKE config, so
+// Rancher waits for the cluster to be registered instead of provisioning it.
+func importedCluster(name, namespace string) *provisioningv1api.Cluster {
+	return &provisioningv1api.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+// importCmd returns the command running the import command of Rancher against the cluster of the given kubeconfig.
+// The insecure command is used as the Rancher server has a self-signed certificate.
+func importCmd(command, kubeconfigPath string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", command)
+	// The kubeconfig is set last so that it takes precedence over any KUBECONFIG of the environment.
+	cmd.Env = append(os.Environ(), "KUBECONFIG="+kubeconfigPath)
+	return cmd
+}
+
+// checkKubeconfig returns an error if the cluster of the given kubeconfig cannot be reached.
+func checkKubeconfig(kubeconfigPath string) error {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	if err != nil {
+		return fmt.Errorf("error loading %s %s: %w", importKubeconfigEnvironmentKey, kubeconfigPath, err)
+	}
+	restConfig.Timeout = 30 * time.Second
+
+	client, err := discovery.NewDiscoveryClientForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("error creating client for the cluster of %s: %w", kubeconfigPath, err)
+	}
+	version, err := client.ServerVersion()
+	if err != nil {
+		return fmt.Errorf("cluster of %s %s is unreachable: %w", importKubeconfigEnvironmentKey, kubeconfigPath, err)
+	}
+
+	logrus.Infof("Cluster of %s is reachable, running Kubernetes %s", kubeconfigPath, version.GitVersion)
+	return nil
+}
+
+// importCommand returns the command registering a cluster with Rancher once its registration token is available,
+// polling for it until timeout.
+func importCommand(clusterClients *clients.Clients, clusterName string, timeout time.Duration) (string, error) {
+	var command string
+	err := kwait.PollUntilContextTimeout(clusterClients.Ctx, pollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		tokens, err := clusterClients.Mgmt.ClusterRegistrationToken().List(clusterName, metav1.ListOptions{})
+		if err != nil || len(tokens.Items) == 0 || tokens.Items[0].Status.InsecureCommand == "" {
+			return false, nil
+		}
+		command = tokens.Items[0].Status.InsecureCommand
+		return true, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error waiting for the registration token of cluster %s: %w", clusterName, err)
+	}
+	return command, nil
+}
+
+// clusterCount returns the number of clusters to create, read from SETUP_CLUSTER_COUNT and defaulting to one.
+func clusterCount() (int, error) {
+	value := os.Getenv(clusterCountEnvironmentKey)
+	if value == "" {
+		return 1, nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %q", clusterCountEnvironmentKey, value)
+	}
+	return count, nil
+}
+
+// setupConfigPath returns the path the test config will be written to. If SETUP_CONFIG_PATH is set, its directory is
+// created if needed and CATTLE_TEST_CONFIG is pointed at it, so the config is both written to and read back from there.
+// Otherwise, the existing CATTLE_TEST_CONFIG path is used, and it is an error if neither is set.
+func setupConfigPath() (string, error) {
+	path := os.Getenv(setupConfigPathEnvironmentKey)
+	if path == "" {
+		path = os.Getenv(configEnvironmentKey)
+		if path == "" {
+			return "", fmt.Errorf("%s or %s must be set to the path to write the test config to", setupConfigPathEnvironmentKey, configEnvironmentKey)
+		}
+		return path, nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating directory %s for %s: %w", dir, setupConfigPathEnvironmentKey, err)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return "", fmt.Errorf("%s %s is a directory, expected a file path", setupConfigPathEnvironmentKey, path)
+	}
+
+	if err := os.Setenv(configEnvironmentKey, path); err != nil {
+		return "", fmt.Errorf("error setting %s: %w", configEnvironmentKey, err)
 	}
 
-	logrus.Infof("Test cluster %s created successfully. Setup complete.", c.Name)
+	return path, nil
 }
 
 // Get preferred outbound ip of this machine
@@ -0,0 +1,308 @@
+//go:build integrationsetup
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRancher is a Rancher server serving /ping, local logins and token creation.
+type fakeRancher struct {
+	*httptest.Server
+	// tokenStatus is the status token creation responds with, 201 if 0.
+	tokenStatus int
+	// notReady is the number of pings responded to with 503 before Rancher is ready, or -1 if it never is.
+	notReady int
+
+	mu sync.Mutex
+	// pings is the number of pings received.
+	pings int
+	// logins are the usernames and passwords logged in with.
+	logins [][2]string
+	// ttls are the TTLs, in milliseconds, of the created tokens.
+	ttls []int64
+}
+
+func newFakeRancher(t *testing.T) *fakeRancher {
+	f := &fakeRancher{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(rw http.ResponseWriter, req *http.Request) {
+		f.mu.Lock()
+		f.pings++
+		ready := f.notReady >= 0 && f.pings > f.notReady
+		f.mu.Unlock()
+		if !ready {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte("pong"))
+	})
+	mux.HandleFunc("/v3-public/localProviders/local", func(rw http.ResponseWriter, req *http.Request) {
+		var login struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&login); err != nil || req.URL.Query().Get("action") != "login" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.logins = append(f.logins, [2]string{login.Username, login.Password})
+		f.mu.Unlock()
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(map[string]string{"token": "login-token"})
+	})
+	mux.HandleFunc("/v3/tokens", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer login-token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var created struct {
+			TTL int64 `json:"ttl"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&created); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.ttls = append(f.ttls, created.TTL)
+		status := f.tokenStatus
+		f.mu.Unlock()
+		if status != 0 {
+			rw.WriteHeader(status)
+			return
+		}
+		rw.WriteHeader(http.StatusCreated)
+		json.NewEncoder(rw).Encode(map[string]string{"token": "ttl-token"})
+	})
+	f.Server = httptest.NewTLSServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// hostURL returns the host and port of the server, as setup expects them.
+func (f *fakeRancher) hostURL() string {
+	return strings.TrimPrefix(f.URL, "https://")
+}
+
+func TestPollWithJitter(t *testing.T) {
+	errCondition := errors.New("condition failed")
+	tests := []struct {
+		name         string
+		interval     time.Duration
+		timeout      time.Duration
+		doneAt       int
+		errAt        int
+		wantAttempts int
+		wantErr      error
+	}{
+		{name: "success on attempt 3", interval: time.Second, timeout: time.Minute, doneAt: 3, wantAttempts: 3},
+		{name: "cap reached at timeout/interval", interval: 100 * time.Millisecond, timeout: time.Second, wantAttempts: 10},
+		{name: "error short-circuits", interval: time.Second, timeout: time.Minute, errAt: 2, wantAttempts: 2, wantErr: errCondition},
+		{name: "at least one attempt", interval: time.Second, timeout: 100 * time.Millisecond, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Waits are recorded instead of slept, so only the attempt cap can end polling.
+			var waits []time.Duration
+			defer func(f func(time.Duration)) { sleep = f }(sleep)
+			sleep = func(d time.Duration) { waits = append(waits, d) }
+
+			attempts, err := pollWithJitter(tt.interval, tt.timeout, func(attempt int) (bool, error) {
+				if attempt == tt.errAt {
+					return false, errCondition
+				}
+				return attempt == tt.doneAt, nil
+			})
+
+			assert.Equal(t, tt.wantAttempts, attempts)
+			switch {
+			case tt.wantErr != nil:
+				assert.ErrorIs(t, err, tt.wantErr)
+			case tt.doneAt == 0:
+				assert.ErrorContains(t, err, "gave up")
+			default:
+				assert.NoError(t, err)
+			}
+			require.Len(t, waits, tt.wantAttempts-1)
+			for _, wait := range waits {
+				assert.GreaterOrEqual(t, wait, tt.interval)
+				assert.LessOrEqual(t, wait, time.Duration(float64(tt.interval)*(1+pollJitterFactor)))
+			}
+		})
+	}
+}
+
+func TestWaitForReady(t *testing.T) {
+	tests := []struct {
+		name      string
+		notReady  int
+		timeout   time.Duration
+		wantPings int
+		wantErr   bool
+	}{
+		{name: "ready", timeout: time.Second, wantPings: 1},
+		{name: "not ready then ready", notReady: 2, timeout: 10 * time.Second, wantPings: 3},
+		{name: "timeout", notReady: -1, timeout: 2 * pollInterval, wantPings: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rancher := newFakeRancher(t)
+			rancher.notReady = tt.notReady
+
+			err := waitForReady(rancher.hostURL(), tt.timeout)
+			if tt.wantErr {
+				assert.ErrorContains(t, err, "error waiting for Rancher")
+			} else {
+				assert.NoError(t, err)
+			}
+			rancher.mu.Lock()
+			defer rancher.mu.Unlock()
+			assert.Equal(t, tt.wantPings, rancher.pings)
+		})
+	}
+}
+
+func TestImportedCluster(t *testing.T) {
+	c := importedCluster("integration-test-cluster-abcde", "fleet-default")
+
+	assert.Equal(t, "integration-test-cluster-abcde", c.Name)
+	assert.Equal(t, "fleet-default", c.Namespace)
+	assert.Nil(t, c.Spec.RKEConfig, "Imported clusters should not be provisioned")
+	assert.Empty(t, c.Spec.KubernetesVersion)
+}
+
+func TestImportCmd(t *testing.T) {
+	t.Setenv("KUBECONFIG", "/root/.kube/config")
+	const command = "curl --insecure -sfL https://rancher/v3/import/abcde.yaml | kubectl apply -f -"
+
+	cmd := importCmd(command, "/tmp/imported.yaml")
+
+	assert.Equal(t, []string{"sh", "-c", command}, cmd.Args)
+	require.NotEmpty(t, cmd.Env)
+	assert.Equal(t, "KUBECONFIG=/tmp/imported.yaml", cmd.Env[len(cmd.Env)-1], "The imported kubeconfig should take precedence")
+	assert.Contains(t, cmd.Env, "KUBECONFIG=/root/.kube/config")
+}
+
+func TestSetupConfigPath(t *testing.T) {
+	t.Run("neither path set", func(t *testing.T) {
+		t.Setenv(setupConfigPathEnvironmentKey, "")
+		t.Setenv(configEnvironmentKey, "")
+		_, err := setupConfigPath()
+		assert.ErrorContains(t, err, configEnvironmentKey)
+	})
+
+	t.Run("test config path", func(t *testing.T) {
+		t.Setenv(setupConfigPathEnvironmentKey, "")
+		t.Setenv(configEnvironmentKey, "/tmp/config.yaml")
+		got, err := setupConfigPath()
+		require.NoError(t, err)
+		assert.Equal(t, "/tmp/config.yaml", got)
+	})
+
+	t.Run("setup config path", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "configs", "config.yaml")
+		t.Setenv(setupConfigPathEnvironmentKey, path)
+		t.Setenv(configEnvironmentKey, "/tmp/config.yaml")
+		got, err := setupConfigPath()
+		require.NoError(t, err)
+		assert.Equal(t, path, got)
+		assert.Equal(t, path, os.Getenv(configEnvironmentKey), "The test config should be read back from the setup path")
+		assert.DirExists(t, filepath.Dir(path))
+	})
+}
+
+func TestTokenTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0s", want: 0},
+		{value: "90m", want: 90 * time.Minute},
+		{value: "-1h", wantErr: true},
+		{value: "1 day", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv(tokenTTLEnvironmentKey, tt.value)
+			got, err := tokenTTL()
+			if tt.wantErr {
+				assert.ErrorContains(t, err, tokenTTLEnvironmentKey)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestGenerateAdminToken(t *testing.T) {
+	t.Run("token without TTL", func(t *testing.T) {
+		rancher := newFakeRancher(t)
+		got, err := generateAdminToken(rancher.hostURL(), time.Second, 0)
+		require.NoError(t, err)
+		assert.Equal(t, "ttl-token", got, "The login token expires with the session, so it should not be used")
+		assert.Equal(t, []int64{0}, rancher.ttls)
+	})
+
+	t.Run("token with TTL", func(t *testing.T) {
+		rancher := newFakeRancher(t)
+		got, err := generateAdminToken(rancher.hostURL(), time.Second, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, "ttl-token", got)
+		assert.Equal(t, []int64{time.Hour.Milliseconds()}, rancher.ttls)
+	})
+
+	t.Run("rejected TTL", func(t *testing.T) {
+		rancher := newFakeRancher(t)
+		rancher.tokenStatus = http.StatusUnprocessableEntity
+		_, err := generateAdminToken(rancher.hostURL(), time.Minute, time.Hour)
+		assert.ErrorContains(t, err, "422")
+		assert.Len(t, rancher.ttls, 1, "A rejected token should not be retried")
+	})
+
+	t.Run("timeout shared with the wait for Rancher", func(t *testing.T) {
+		rancher := newFakeRancher(t)
+		rancher.notReady = 4
+		rancher.tokenStatus = http.StatusServiceUnavailable
+		const timeout = 6 * pollInterval
+
+		start := time.Now()
+		_, err := generateAdminToken(rancher.hostURL(), timeout, time.Hour)
+		assert.ErrorContains(t, err, "gave up")
+		// Waiting for Rancher alone takes at least 4 intervals, retrying token creation for the whole timeout on top
+		// of it would take at least 9.
+		assert.Less(t, time.Since(start), timeout+2*pollInterval)
+	})
+}
+
+func TestRefreshAdminToken(t *testing.T) {
+	rancher := newFakeRancher(t)
+
+	got, err := refreshAdminToken(rancher.hostURL(), adminCredentials{Username: "admin", TokenTTL: "2h0m0s"}, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "ttl-token", got)
+	assert.Equal(t, [][2]string{{"admin", "secret"}}, rancher.logins)
+	assert.Equal(t, []int64{(2 * time.Hour).Milliseconds()}, rancher.ttls)
+
+	_, err = refreshAdminToken(rancher.hostURL(), adminCredentials{Username: "admin"}, "secret")
+	assert.ErrorContains(t, err, "tokenTTL")
+
+	rancher.tokenStatus = http.StatusUnauthorized
+	_, err = refreshAdminToken(rancher.hostURL(), adminCredentials{Username: "admin", TokenTTL: "1h"}, "secret")
+	assert.ErrorContains(t, err, "401")
+}